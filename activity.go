@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github/ntvviktor/GoServer/internal/database"
+	"log"
+	"sync"
+	"time"
+)
+
+// activityFlushInterval is how often last-seen times are written to the
+// database.
+const activityFlushInterval = 5 * time.Minute
+
+// activity collects when sessions and API keys were last used, so requests
+// do not each write to the database, and flushActivity stores them in one
+// write. Like loginThrottle it lives in memory: a restart only loses the
+// last few minutes of last-seen times.
+type activity struct {
+	mux      sync.Mutex
+	sessions map[int]database.SessionActivity
+	apiKeys  map[string]time.Time
+}
+
+func newActivity() *activity {
+	return &activity{
+		sessions: map[int]database.SessionActivity{},
+		apiKeys:  map[string]time.Time{},
+	}
+}
+
+func (a *activity) seenSession(id int, ip string) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.sessions[id] = database.SessionActivity{At: time.Now().UTC(), IP: ip}
+}
+
+func (a *activity) seenAPIKey(hash string) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.apiKeys[hash] = time.Now().UTC()
+}
+
+// session returns the activity on a session not yet flushed, if any.
+func (a *activity) session(id int) (database.SessionActivity, bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	seen, ok := a.sessions[id]
+	return seen, ok
+}
+
+// apiKey returns when a key was last used if that is not yet flushed.
+func (a *activity) apiKey(hash string) (time.Time, bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	at, ok := a.apiKeys[hash]
+	return at, ok
+}
+
+// take hands over everything collected so far and starts afresh.
+func (a *activity) take() (map[int]database.SessionActivity, map[string]time.Time) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	sessions, apiKeys := a.sessions, a.apiKeys
+	a.sessions = map[int]database.SessionActivity{}
+	a.apiKeys = map[string]time.Time{}
+	return sessions, apiKeys
+}
+
+// putBack returns activity that could not be stored, unless something newer
+// came in meanwhile.
+func (a *activity) putBack(sessions map[int]database.SessionActivity, apiKeys map[string]time.Time) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	for id, seen := range sessions {
+		if _, ok := a.sessions[id]; !ok {
+			a.sessions[id] = seen
+		}
+	}
+	for hash, at := range apiKeys {
+		if _, ok := a.apiKeys[hash]; !ok {
+			a.apiKeys[hash] = at
+		}
+	}
+}
+
+func (apiConfig *apiConfig) flushActivity() {
+	sessions, apiKeys := apiConfig.activity.take()
+	err := apiConfig.DB.RecordActivity(sessions, apiKeys)
+	if err != nil {
+		log.Printf("recording activity: %v", err)
+		apiConfig.activity.putBack(sessions, apiKeys)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github/ntvviktor/GoServer/internal/database"
+	"testing"
+	"time"
+)
+
+// Requests only note activity in memory; the flush writes all of it at once.
+func TestFlushActivity(t *testing.T) {
+	db := database.NewMemoryDB()
+	user, err := db.CreateUser("alice@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := db.CreateSession(database.Session{UserID: user.ID, IP: "192.0.2.1"}, "token", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := db.CreateAPIKey(database.APIKey{UserID: user.ID, Hash: "key-hash", ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiConfig := &apiConfig{DB: db, activity: newActivity()}
+
+	apiConfig.activity.seenSession(session.ID, "192.0.2.2")
+	apiConfig.activity.seenAPIKey(key.Hash)
+	apiConfig.activity.seenSession(42, "192.0.2.3")
+	got, err := db.GetSession(session.ID)
+	if err != nil || got.IP != "192.0.2.1" {
+		t.Errorf("session before the flush = %+v, %v; want it unchanged", got, err)
+	}
+
+	apiConfig.flushActivity()
+	got, err = db.GetSession(session.ID)
+	if err != nil || got.IP != "192.0.2.2" || !got.LastSeenAt.After(session.LastSeenAt) {
+		t.Errorf("session after the flush = %+v, %v; want the new address and time", got, err)
+	}
+	gotKey, err := db.GetAPIKeyByHash(key.Hash)
+	if err != nil || gotKey.LastUsedAt == nil {
+		t.Errorf("API key after the flush = %+v, %v; want a last-used time", gotKey, err)
+	}
+	_, pending := apiConfig.activity.session(session.ID)
+	if pending {
+		t.Error("activity still pending after the flush")
+	}
+}
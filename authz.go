@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"github/ntvviktor/GoServer/internal/auth"
+	"github/ntvviktor/GoServer/internal/database"
+	"net/http"
+	"slices"
+)
+
+// roleRank orders the roles: each one may do everything the ones below it
+// may.
+var roleRank = map[string]int{
+	database.RoleUser:      1,
+	database.RoleModerator: 2,
+	database.RoleAdmin:     3,
+}
+
+func hasRole(role string, want string) bool {
+	return roleRank[role] >= roleRank[want]
+}
+
+// roleScopes are the scopes a first-party login gets for a role.
+func roleScopes(role string) []string {
+	scopes := append([]string{auth.ScopeAccount}, auth.GrantableScopes...)
+	if hasRole(role, database.RoleModerator) {
+		scopes = append(scopes, auth.ScopeModerate)
+	}
+	if hasRole(role, database.RoleAdmin) {
+		scopes = append(scopes, auth.ScopeAdmin)
+	}
+	return scopes
+}
+
+// roleScope is the scope a token needs on top of the role, so a token the
+// user granted to an OAuth client never carries their role's privileges.
+var roleScope = map[string]string{
+	database.RoleUser:      auth.ScopeChirpsRead,
+	database.RoleModerator: auth.ScopeModerate,
+	database.RoleAdmin:     auth.ScopeAdmin,
+}
+
+// requireRole lets a request through only if the caller, as identified by
+// middlewareAuth, has at least the given role.
+func requireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			caller := requestIdentity(req)
+			if !hasRole(caller.Role, role) || !slices.Contains(caller.Scopes, roleScope[role]) {
+				respondWithError(w, http.StatusForbidden, "Forbidden")
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// requireScope lets a request through only if the caller's token carries
+// scope.
+func requireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !slices.Contains(requestIdentity(req).Scopes, scope) {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+				respondWithError(w, http.StatusForbidden, "Insufficient scope")
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
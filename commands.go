@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github/ntvviktor/GoServer/internal/auth"
+	"github/ntvviktor/GoServer/internal/database"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// runCommand runs one of the maintenance subcommands instead of the server.
+func runCommand(name string, args []string) error {
+	switch name {
+	case "migrate":
+		return runMigrate(args)
+	case "backup":
+		return runBackup(args)
+	case "restore":
+		return runRestore(args)
+	case "export":
+		return runExport(args)
+	case "keys":
+		return runKeys(args)
+	case "role":
+		return runRole(args)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+// openCommandDB opens the database for a maintenance command that writes. A
+// running server holds the database, and a command writing behind its back
+// would lose data, so these commands refuse to run alongside one.
+func openCommandDB(opts ...database.Option) (*database.DB, error) {
+	db, err := openDB(os.Getenv("DB_ENGINE"), "database.json", opts...)
+	if errors.Is(err, database.ErrLocked) {
+		return nil, fmt.Errorf("%w: stop the server first", err)
+	}
+	return db, err
+}
+
+// openCommandSnapshot reads the database for a command that only reads,
+// which works whether or not the server is running.
+func openCommandSnapshot() (*database.DB, error) {
+	return openReadOnlyDB(os.Getenv("DB_ENGINE"), "database.json")
+}
+
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "report pending migrations without applying them")
+	flags.Parse(args)
+
+	db, err := openCommandDB(database.WithoutMigrations())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("schema version %d, latest %d\n", version, database.LatestSchemaVersion())
+
+	applied, err := db.Migrate(*dryRun)
+	if err != nil {
+		return err
+	}
+	for _, m := range applied {
+		fmt.Printf("  %d: %s\n", m.Version, m.Description)
+	}
+	switch {
+	case len(applied) == 0:
+		fmt.Println("nothing to migrate")
+	case *dryRun:
+		fmt.Printf("%d pending migration(s), none applied\n", len(applied))
+	default:
+		fmt.Printf("applied %d migration(s)\n", len(applied))
+	}
+	return nil
+}
+
+func runBackup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := flags.String("out", "", "file to write the backup to (default database-backup-<time>.json)")
+	flags.Parse(args)
+	if *out == "" {
+		*out = fmt.Sprintf("database-backup-%s.json", time.Now().UTC().Format("20060102T150405Z"))
+	}
+
+	db, err := openCommandSnapshot()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	file, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = db.Snapshot(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*out)
+		return err
+	}
+	fmt.Printf("backed up to %s\n", *out)
+	return nil
+}
+
+func runRestore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: restore <backup file>")
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	db, err := openCommandDB()
+	if errors.Is(err, database.ErrLocked) {
+		return fmt.Errorf("%w, or restore through POST /admin/restore", err)
+	}
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	err = db.Restore(file)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored from %s\n", flags.Arg(0))
+	return nil
+}
+
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "jsonl", "jsonl or csv")
+	tables := flags.String("tables", strings.Join(database.Tables(), ","), "comma separated tables to export; csv takes exactly one")
+	out := flags.String("out", "", "file to write to (default stdout)")
+	flags.Parse(args)
+
+	db, err := openCommandSnapshot()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	names := strings.Split(*tables, ",")
+	switch *format {
+	case "jsonl":
+		return db.ExportJSONL(w, names...)
+	case "csv":
+		if len(names) != 1 {
+			return fmt.Errorf("csv export takes exactly one table, got %q", *tables)
+		}
+		return db.ExportCSV(w, names[0])
+	default:
+		return fmt.Errorf("unknown export format %q", *format)
+	}
+}
+
+func runKeys(args []string) error {
+	flags := flag.NewFlagSet("keys", flag.ExitOnError)
+	alg := flags.String("alg", auth.AlgEdDSA, "algorithm for rotate: EdDSA or RS256")
+	flags.Parse(args)
+
+	switch flags.Arg(0) {
+	case "rotate":
+		kid, err := auth.GenerateKeyFile(keysDir(), *alg)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("new signing key %s; previous keys keep verifying until their files are removed\n", kid)
+		return nil
+	case "list":
+		keys, err := loadKeys()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys.JWKS().Keys {
+			fmt.Printf("%s\t%s\n", key.Kid, key.Alg)
+		}
+		return nil
+	default:
+		return fmt.Errorf("usage: keys [-alg EdDSA|RS256] rotate|list")
+	}
+}
+
+// runRole sets the role of the user with the given email. It is how the
+// first admin gets made.
+func runRole(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: role <email> user|moderator|admin")
+	}
+	db, err := openCommandDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	user, err := db.GetUserByEmail(args[0])
+	if err != nil {
+		return err
+	}
+	user, err = db.SetUserRole(user.ID, args[1])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("user %d (%s) is now %s\n", user.ID, user.Email, user.Role)
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// exportTTL is how long a finished data export can be downloaded before it
+// has to be made again.
+const exportTTL = time.Hour
+
+// dataExports keeps the latest data export of each user while it is built
+// and for exportTTL after. Like loginThrottle it lives in memory: a restart
+// only means asking again.
+type dataExports struct {
+	mux     sync.Mutex
+	exports map[int]dataExport
+}
+
+type dataExport struct {
+	requestedAt time.Time
+	// readyAt is zero while the export is being built.
+	readyAt time.Time
+	archive []byte
+}
+
+func newDataExports() *dataExports {
+	return &dataExports{
+		exports: map[int]dataExport{},
+	}
+}
+
+func (e dataExport) ready() bool {
+	return !e.readyAt.IsZero()
+}
+
+// get returns the user's export, starting to build one with build if there
+// is none that is current.
+func (d *dataExports) get(userID int, build func() ([]byte, error)) dataExport {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	export, ok := d.exports[userID]
+	if ok && (!export.ready() || time.Since(export.readyAt) < exportTTL) {
+		return export
+	}
+
+	export = dataExport{requestedAt: time.Now().UTC()}
+	d.exports[userID] = export
+	go func() {
+		archive, err := build()
+		d.mux.Lock()
+		defer d.mux.Unlock()
+		if d.exports[userID].requestedAt != export.requestedAt {
+			return
+		}
+		if err != nil {
+			// Let the next request try again.
+			delete(d.exports, userID)
+			return
+		}
+		d.exports[userID] = dataExport{
+			requestedAt: export.requestedAt,
+			readyAt:     time.Now().UTC(),
+			archive:     archive,
+		}
+	}()
+	return export
+}
+
+func (d *dataExports) remove(userID int) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	delete(d.exports, userID)
+}
+
+func (d *dataExports) prune() {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	for k, v := range d.exports {
+		if v.ready() && time.Since(v.readyAt) >= exportTTL {
+			delete(d.exports, k)
+		}
+	}
+}
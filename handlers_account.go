@@ -0,0 +1,236 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github/ntvviktor/GoServer/internal/database"
+	"github/ntvviktor/GoServer/internal/mailer"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Account deletion policies, picked with ACCOUNT_DELETION.
+const (
+	deletionDelete    = "delete"
+	deletionAnonymize = "anonymize"
+)
+
+// reauthWindow is how recent the login of a user without a password must be
+// for them to delete their account.
+const reauthWindow = time.Minute * 10
+
+// handleDeleteUser deletes the caller's account once they confirmed it with
+// their password, and their second factor if they have one. What happens to
+// their chirps depends on the deletion policy; see database.DeleteUser.
+func (apiConfig *apiConfig) handleDeleteUser(w http.ResponseWriter, req *http.Request) {
+	type parameter struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	decoder := json.NewDecoder(req.Body)
+	param := parameter{}
+	err := decoder.Decode(&param)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Malformed JSON Request")
+		return
+	}
+
+	user, err := apiConfig.DB.GetUser(requestIdentity(req).UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if !apiConfig.reauthenticate(w, req, user, param.Password) {
+		return
+	}
+	if user.TOTPEnabled {
+		ip := clientIP(req)
+		wait := apiConfig.loginThrottle.reserve(user.Email, ip)
+		if wait > 0 {
+			respondTooManyAttempts(w, wait)
+			return
+		}
+		err = apiConfig.checkSecondFactor(user, param.Code, param.RecoveryCode)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Invalid code")
+			return
+		}
+		apiConfig.loginThrottle.release(user.Email, ip)
+	}
+
+	err = apiConfig.DB.DeleteUser(user.ID, apiConfig.accountDeletion == deletionAnonymize)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete account")
+		return
+	}
+	apiConfig.dataExports.remove(user.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reauthenticate has the caller prove they are still user before a change
+// that a stolen token must not be able to make: with their password, or for
+// an account without one, by having logged in within reauthWindow. On
+// failure it has already responded.
+func (apiConfig *apiConfig) reauthenticate(w http.ResponseWriter, req *http.Request, user database.User, password string) bool {
+	if user.Password == "" {
+		// Accounts that log in through a provider prove it is them by
+		// having just done so.
+		session, err := apiConfig.DB.GetSession(requestIdentity(req).SessionID)
+		if err != nil || time.Since(session.CreatedAt) > reauthWindow {
+			respondWithError(w, http.StatusUnauthorized, "Log in again to make this change")
+			return false
+		}
+		return true
+	}
+	_, err := apiConfig.checkPassword(user.Email, password, clientIP(req))
+	throttled := throttledError{}
+	switch {
+	case errors.As(err, &throttled):
+		respondTooManyAttempts(w, throttled.wait)
+		return false
+	case err != nil:
+		respondWithError(w, http.StatusUnauthorized, "Incorrect password")
+		return false
+	}
+	return true
+}
+
+// handleExportUser answers with an archive of the caller's data. The archive
+// is built in the background: until it is ready the answer is 202 and the
+// client should ask again, as the Retry-After header says.
+func (apiConfig *apiConfig) handleExportUser(w http.ResponseWriter, req *http.Request) {
+	userID := requestIdentity(req).UserID
+	export := apiConfig.dataExports.get(userID, func() ([]byte, error) {
+		archive, err := apiConfig.buildExport(userID)
+		if err != nil {
+			log.Printf("exporting data of user %d: %v", userID, err)
+			return nil, err
+		}
+		apiConfig.sendExportReadyEmail(userID)
+		return archive, nil
+	})
+
+	if !export.ready() {
+		type response struct {
+			Status      string    `json:"status"`
+			RequestedAt time.Time `json:"requested_at"`
+		}
+		w.Header().Set("Retry-After", "5")
+		respondWithJSON(w, http.StatusAccepted, response{
+			Status:      "pending",
+			RequestedAt: export.requestedAt,
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chirpy-export-%d-%s.zip"`, userID, export.readyAt.Format("20060102T150405Z")))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(export.archive)
+}
+
+// buildExport zips one JSON file per kind of data the user has, including
+// deleted chirps that are not purged yet. Secrets, such as hashes and TOTP
+// seeds, are left out.
+func (apiConfig *apiConfig) buildExport(userID int) ([]byte, error) {
+	user, err := apiConfig.DB.GetUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	chirps, err := apiConfig.DB.GetChirpsByAuthor(userID)
+	if err != nil {
+		return nil, err
+	}
+	deletedChirps, err := apiConfig.DB.GetDeletedChirpsByAuthor(userID)
+	if err != nil {
+		return nil, err
+	}
+	chirps = append(chirps, deletedChirps...)
+	slices.SortFunc(chirps, func(a, b database.Chirp) int {
+		return a.ID - b.ID
+	})
+	sessions, err := apiConfig.DB.ListSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+	sessionsResponse := make([]Session, 0, len(sessions))
+	for _, v := range sessions {
+		sessionsResponse = append(sessionsResponse, newSessionResponse(v, 0))
+	}
+	identities, err := apiConfig.DB.ListIdentities(userID)
+	if err != nil {
+		return nil, err
+	}
+	identitiesResponse := make([]Identity, 0, len(identities))
+	for _, v := range identities {
+		identitiesResponse = append(identitiesResponse, newIdentityResponse(v))
+	}
+	keys, err := apiConfig.DB.ListAPIKeys(userID)
+	if err != nil {
+		return nil, err
+	}
+	keysResponse := make([]APIKey, 0, len(keys))
+	for _, v := range keys {
+		keysResponse = append(keysResponse, newAPIKeyResponse(v))
+	}
+	clients, err := apiConfig.DB.ListOAuthClients(userID)
+	if err != nil {
+		return nil, err
+	}
+	clientsResponse := make([]OAuthClient, 0, len(clients))
+	for _, v := range clients {
+		clientsResponse = append(clientsResponse, newOAuthClientResponse(v))
+	}
+
+	files := []struct {
+		name string
+		data any
+	}{
+		{"profile.json", newMeResponse(user)},
+		{"chirps.json", apiConfig.newChirpResponses(chirps)},
+		{"sessions.json", sessionsResponse},
+		{"identities.json", identitiesResponse},
+		{"api_keys.json", keysResponse},
+		{"oauth_clients.json", clientsResponse},
+	}
+	buf := &bytes.Buffer{}
+	archive := zip.NewWriter(buf)
+	for _, v := range files {
+		f, err := archive.Create(v.name)
+		if err != nil {
+			return nil, err
+		}
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(v.data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = archive.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (apiConfig *apiConfig) sendExportReadyEmail(userID int) {
+	user, err := apiConfig.DB.GetUser(userID)
+	if err != nil || user.Email == "" {
+		return
+	}
+	err = apiConfig.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Your Chirpy data export is ready",
+		Body:    fmt.Sprintf("The export of your data you asked for is ready. Download it from your account within the hour:\n\n%s\n", apiConfig.appURL),
+	})
+	if err != nil {
+		log.Printf("sending export email: %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github/ntvviktor/GoServer/internal/database"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func (apiConfig *apiConfig) handleBackup(w http.ResponseWriter, req *http.Request) {
+	filename := fmt.Sprintf("database-backup-%s.json", time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	err := apiConfig.DB.Snapshot(w)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create backup")
+		return
+	}
+}
+
+// handleRestore replaces the whole database with a backup made by
+// handleBackup, without stopping the server.
+func (apiConfig *apiConfig) handleRestore(w http.ResponseWriter, req *http.Request) {
+	err := apiConfig.DB.Restore(req.Body)
+	switch {
+	case errors.Is(err, database.ErrInvalidBackup):
+		respondWithError(w, http.StatusBadRequest, "Malformed backup")
+		return
+	case errors.Is(err, database.ErrSchemaTooNew):
+		respondWithError(w, http.StatusBadRequest, "Backup is from a newer version of the server")
+		return
+	case err != nil:
+		respondWithError(w, http.StatusInternalServerError, "Couldn't restore backup")
+		return
+	}
+	// Activity noted before the restore belongs to sessions that may be
+	// gone or stand for others now.
+	apiConfig.activity.take()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleUnlockUser lifts the failed-login lockout of an account.
+func (apiConfig *apiConfig) handleUnlockUser(w http.ResponseWriter, req *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(req, "userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Malformed URL request")
+		return
+	}
+	user, err := apiConfig.DB.GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	apiConfig.loginThrottle.unlock(user.Email)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSetUserRole changes the role of a user. Their current access tokens
+// stop working and have to be refreshed to carry the new role.
+func (apiConfig *apiConfig) handleSetUserRole(w http.ResponseWriter, req *http.Request) {
+	type parameter struct {
+		Role string `json:"role"`
+	}
+	userID, err := strconv.Atoi(chi.URLParam(req, "userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Malformed URL request")
+		return
+	}
+	decoder := json.NewDecoder(req.Body)
+	param := parameter{}
+	err = decoder.Decode(&param)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Malformed JSON Request")
+		return
+	}
+	user, err := apiConfig.DB.SetUserRole(userID, param.Role)
+	if err != nil {
+		if errors.Is(err, database.ErrInvalidRole) {
+			respondWithError(w, http.StatusBadRequest, "Invalid role")
+			return
+		}
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	type response struct {
+		ID   int    `json:"id"`
+		Role string `json:"role"`
+	}
+	respondWithJSON(w, http.StatusOK, response{
+		ID:   user.ID,
+		Role: user.Role,
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github/ntvviktor/GoServer/internal/auth"
+	"github/ntvviktor/GoServer/internal/database"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	// Key is only ever set in the response that created it.
+	Key string `json:"key,omitempty"`
+}
+
+func newAPIKeyResponse(key database.APIKey) APIKey {
+	return APIKey{
+		ID:         key.ID,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     key.Scopes,
+		CreatedAt:  key.CreatedAt,
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+	}
+}
+
+// apiKeyScopes are the scopes a user of role can put on a personal API key:
+// those of their logins except ScopeAccount, so a leaked key cannot take
+// over the account.
+func apiKeyScopes(role string) []string {
+	return slices.DeleteFunc(roleScopes(role), func(scope string) bool {
+		return scope == auth.ScopeAccount
+	})
+}
+
+// handleCreateAPIKey mints a personal API key for the caller. The key is
+// only ever shown here.
+func (apiConfig *apiConfig) handleCreateAPIKey(w http.ResponseWriter, req *http.Request) {
+	type parameter struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+	decoder := json.NewDecoder(req.Body)
+	param := parameter{}
+	err := decoder.Decode(&param)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Malformed JSON Request")
+		return
+	}
+	if param.Name == "" {
+		respondWithError(w, http.StatusBadRequest, "A name is required")
+		return
+	}
+	caller := requestIdentity(req)
+	scopes, err := auth.ParseScope(strings.Join(param.Scopes, " "), apiKeyScopes(caller.Role))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid scopes, allowed are "+strings.Join(apiKeyScopes(caller.Role), ", "))
+		return
+	}
+	ttl := auth.DefaultAPIKeyTTL
+	if param.ExpiresInDays != 0 {
+		ttl = time.Duration(param.ExpiresInDays) * time.Hour * 24
+	}
+	if ttl <= 0 || ttl > auth.MaxAPIKeyTTL {
+		respondWithError(w, http.StatusBadRequest, "expires_in_days must be between 1 and 365")
+		return
+	}
+
+	key, keyHash, err := auth.NewAPIKey()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create API key")
+		return
+	}
+	apiKey, err := apiConfig.DB.CreateAPIKey(database.APIKey{
+		Hash:      keyHash,
+		Prefix:    key[:len(auth.APIKeyPrefix)+4],
+		Name:      param.Name,
+		UserID:    caller.UserID,
+		Scopes:    scopes,
+		ExpiresAt: time.Now().UTC().Add(ttl),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create API key")
+		return
+	}
+	response := newAPIKeyResponse(apiKey)
+	response.Key = key
+	respondWithJSON(w, http.StatusCreated, response)
+}
+
+func (apiConfig *apiConfig) handleListAPIKeys(w http.ResponseWriter, req *http.Request) {
+	keys, err := apiConfig.DB.ListAPIKeys(requestIdentity(req).UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list API keys")
+		return
+	}
+	response := make([]APIKey, 0, len(keys))
+	for _, v := range keys {
+		if at, ok := apiConfig.activity.apiKey(v.Hash); ok {
+			v.LastUsedAt = &at
+		}
+		response = append(response, newAPIKeyResponse(v))
+	}
+	sort.Slice(response, func(i, j int) bool {
+		return response[i].ID < response[j].ID
+	})
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+func (apiConfig *apiConfig) handleDeleteAPIKey(w http.ResponseWriter, req *http.Request) {
+	keyID, err := strconv.Atoi(chi.URLParam(req, "keyID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Malformed URL request")
+		return
+	}
+	err = apiConfig.DB.DeleteAPIKey(keyID, requestIdentity(req).UserID)
+	if err != nil {
+		if errors.Is(err, database.ErrNotExist) {
+			respondWithError(w, http.StatusNotFound, "API key not found")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke API key")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (apiConfig *apiConfig) purgeExpiredAPIKeys() {
+	_, err := apiConfig.DB.PurgeExpiredAPIKeys(time.Now())
+	if err != nil {
+		log.Printf("purging expired API keys: %v", err)
+	}
+}
@@ -2,84 +2,99 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
 	"github.com/go-chi/chi/v5"
-	"github/ntvviktor/GoServer/internal/auth"
 	"github/ntvviktor/GoServer/internal/database"
 	"log"
 	"net/http"
 	"sort"
 	"strconv"
+	"time"
 )
 
 type Chirp struct {
 	ID       int    `json:"id"`
 	Body     string `json:"body"`
 	AuthorID int    `json:"author_id"`
+	// AuthorHandle is empty for chirps kept after their author deleted
+	// their account.
+	AuthorHandle string `json:"author_handle"`
+	// DeletedAt is only ever set in data exports, which include deleted
+	// chirps that can still be restored, and in the response to deleting a
+	// chirp.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
-func (apiConfig *apiConfig) handlePostChirps(w http.ResponseWriter, req *http.Request) {
-	tokenString, canCut := getTokenFromHeader(req)
-	if !canCut {
-		respondWithError(w, http.StatusBadRequest, "Malformed  JSON token")
-		return
-	}
-	authorID, _, err := auth.ValidateJWT(tokenString, apiConfig.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Invalid Token")
-		return
+// newChirpResponses renders chirps with the handles of their authors.
+func (apiConfig *apiConfig) newChirpResponses(chirps []database.Chirp) []Chirp {
+	handles := map[int]string{}
+	response := make([]Chirp, 0, len(chirps))
+	for _, v := range chirps {
+		handle, ok := handles[v.AuthorID]
+		if !ok {
+			author, err := apiConfig.DB.GetUser(v.AuthorID)
+			if err == nil {
+				handle = author.Handle
+			}
+			handles[v.AuthorID] = handle
+		}
+		response = append(response, Chirp{
+			ID:           v.ID,
+			Body:         v.Body,
+			AuthorID:     v.AuthorID,
+			AuthorHandle: handle,
+			DeletedAt:    v.DeletedAt,
+		})
 	}
+	return response
+}
+
+func (apiConfig *apiConfig) handlePostChirps(w http.ResponseWriter, req *http.Request) {
+	authorID := requestIdentity(req).UserID
 	decoder := json.NewDecoder(req.Body)
 	type parameter struct {
 		Body string `json:"body"`
 	}
 	param := parameter{}
-	err = decoder.Decode(&param)
+	err := decoder.Decode(&param)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Malformed  JSON token")
 		return
 	}
 	chirp, err := apiConfig.DB.CreateChirp(param.Body, authorID)
-	type response struct {
-		Chirp
-	}
-	respondWithJSON(w, http.StatusCreated, response{
-		Chirp{
-			ID:       chirp.ID,
-			Body:     param.Body,
-			AuthorID: chirp.AuthorID,
-		},
-	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create chirp")
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, apiConfig.newChirpResponses([]database.Chirp{chirp})[0])
 }
 
 func (apiConfig *apiConfig) handleGetChirps(w http.ResponseWriter, req *http.Request) {
 	var responseChirps []database.Chirp
-	var authorID int
+	var err error
 	authorIDString := req.URL.Query().Get("author_id")
+	authorHandle := req.URL.Query().Get("author_handle")
 
-	chirps, err := apiConfig.DB.GetChirps()
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Internal error")
-		return
-	}
-	if authorIDString == "" {
-		responseChirps = chirps
+	if authorHandle != "" {
+		author, handleErr := apiConfig.DB.GetUserByHandle(normalizeHandle(authorHandle))
+		if handleErr != nil {
+			respondWithError(w, http.StatusNotFound, "User not found")
+			return
+		}
+		responseChirps, err = apiConfig.DB.GetChirpsByAuthor(author.ID)
+	} else if authorIDString == "" {
+		responseChirps, err = apiConfig.DB.GetChirps()
 	} else {
-		authorID, err = strconv.Atoi(authorIDString)
-		if err != nil {
+		authorID, convErr := strconv.Atoi(authorIDString)
+		if convErr != nil {
 			respondWithError(w, http.StatusBadRequest, "Internal error")
 			return
 		}
-		for _, v := range chirps {
-			if v.AuthorID == authorID {
-				chirp := database.Chirp{
-					ID:       v.ID,
-					Body:     v.Body,
-					AuthorID: v.AuthorID,
-				}
-				responseChirps = append(responseChirps, chirp)
-			}
-		}
+		responseChirps, err = apiConfig.DB.GetChirpsByAuthor(authorID)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Internal error")
+		return
 	}
 
 	sortCriteria := req.URL.Query().Get("sort")
@@ -92,57 +107,113 @@ func (apiConfig *apiConfig) handleGetChirps(w http.ResponseWriter, req *http.Req
 			return responseChirps[i].ID < responseChirps[j].ID
 		})
 	}
-	respondWithJSON(w, http.StatusOK, responseChirps)
+	respondWithJSON(w, http.StatusOK, apiConfig.newChirpResponses(responseChirps))
 }
 
 func (apiConfig *apiConfig) handleDeleteChirp(w http.ResponseWriter, req *http.Request) {
-	tokenString, canCut := getTokenFromHeader(req)
-	if !canCut {
-		respondWithError(w, http.StatusBadRequest, "Malformed  JSON token")
+	authorID := requestIdentity(req).UserID
+	paramID := chi.URLParam(req, "chirpID")
+	chirpID, err := strconv.Atoi(paramID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Malformed URL request")
 		return
 	}
-	authorID, _, err := auth.ValidateJWT(tokenString, apiConfig.jwtSecret)
+	chirp, err := apiConfig.DB.DeleteChirp(chirpID, authorID)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Invalid Token")
+		respondWithJSON(w, http.StatusForbidden, "Cannot delete")
 		return
 	}
-	paramID := chi.URLParam(req, "chirpID")
-	chirpID, err := strconv.Atoi(paramID)
+	respondWithJSON(w, http.StatusOK, apiConfig.newChirpResponses([]database.Chirp{chirp})[0])
+}
+
+// handleModerateChirp takes down any chirp. The author cannot restore it.
+func (apiConfig *apiConfig) handleModerateChirp(w http.ResponseWriter, req *http.Request) {
+	chirpID, err := strconv.Atoi(chi.URLParam(req, "chirpID"))
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Malformed URL request")
 		return
 	}
-	chirp, err := apiConfig.DB.DeleteChirp(chirpID, authorID)
+	chirp, err := apiConfig.DB.ModerateChirp(chirpID, requestIdentity(req).UserID)
 	if err != nil {
-		respondWithJSON(w, http.StatusForbidden, "Cannot delete")
+		respondWithError(w, http.StatusNotFound, "Chirp not found")
 		return
 	}
-	respondWithJSON(w, http.StatusOK, chirp)
+	respondWithJSON(w, http.StatusOK, apiConfig.newChirpResponses([]database.Chirp{chirp})[0])
 }
 
 func (apiConfig *apiConfig) getChirpsById(w http.ResponseWriter, req *http.Request) {
-	id := chi.URLParam(req, "chirpID")
-	chirps, err := apiConfig.DB.GetChirps()
+	chirpID, err := strconv.Atoi(chi.URLParam(req, "chirpID"))
 	if err != nil {
-		http.Error(w, "Internal Error", 500)
-		log.Fatal(err)
+		respondWithError(w, http.StatusBadRequest, "Malformed URL request")
+		return
 	}
-	sort.Slice(chirps, func(i, j int) bool {
-		return chirps[i].ID < chirps[j].ID
-	})
-	chirpID, err := strconv.Atoi(id)
+	chirp, err := apiConfig.DB.GetChirpByID(chirpID)
 	if err != nil {
-		http.Error(w, "Internal Error", 500)
-		log.Fatal(err)
-	}
-	for _, v := range chirps {
-		if chirpID == v.ID {
-			w.WriteHeader(200)
-			dat, _ := json.Marshal(v)
-			w.Write(dat)
-			fmt.Println(string(dat))
+		if errors.Is(err, database.ErrNotExist) {
+			w.WriteHeader(http.StatusNotFound)
 			return
 		}
+		respondWithError(w, http.StatusInternalServerError, "Internal Error")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, apiConfig.newChirpResponses([]database.Chirp{chirp})[0])
+}
+
+func (apiConfig *apiConfig) handleRestoreChirp(w http.ResponseWriter, req *http.Request) {
+	authorID := requestIdentity(req).UserID
+	chirpID, err := strconv.Atoi(chi.URLParam(req, "chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Malformed URL request")
+		return
+	}
+	chirp, err := apiConfig.DB.GetDeletedChirp(chirpID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Deleted chirp not found")
+		return
+	}
+	// Chirps taken down by a moderator can only be restored by an admin.
+	if chirp.AuthorID != authorID || chirp.DeletedBy != authorID {
+		respondWithError(w, http.StatusForbidden, "Cannot restore")
+		return
+	}
+	apiConfig.restoreChirp(w, chirp)
+}
+
+func (apiConfig *apiConfig) handleAdminRestoreChirp(w http.ResponseWriter, req *http.Request) {
+	chirpID, err := strconv.Atoi(chi.URLParam(req, "chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Malformed URL request")
+		return
+	}
+	chirp, err := apiConfig.DB.GetDeletedChirp(chirpID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Deleted chirp not found")
+		return
+	}
+	apiConfig.restoreChirp(w, chirp)
+}
+
+func (apiConfig *apiConfig) restoreChirp(w http.ResponseWriter, chirp database.Chirp) {
+	if time.Since(*chirp.DeletedAt) > apiConfig.chirpRetention {
+		respondWithError(w, http.StatusGone, "Retention window has passed")
+		return
+	}
+	restored, err := apiConfig.DB.RestoreChirp(chirp.ID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Deleted chirp not found")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, apiConfig.newChirpResponses([]database.Chirp{restored})[0])
+}
+
+// purgeDeletedChirps hard-deletes chirps whose retention window has passed.
+func (apiConfig *apiConfig) purgeDeletedChirps() {
+	purged, err := apiConfig.DB.PurgeDeletedChirps(time.Now().Add(-apiConfig.chirpRetention))
+	if err != nil {
+		log.Printf("purging deleted chirps: %v", err)
+		return
+	}
+	if purged > 0 {
+		log.Printf("purged %d deleted chirps", purged)
 	}
-	w.WriteHeader(404)
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github/ntvviktor/GoServer/internal/auth"
+	"github/ntvviktor/GoServer/internal/database"
+	"github/ntvviktor/GoServer/internal/mailer"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// handlePasswordResetRequest mails a reset link if the email belongs to a
+// user. The answer is the same either way, so it cannot be used to find out
+// who has an account.
+func (apiConfig *apiConfig) handlePasswordResetRequest(w http.ResponseWriter, req *http.Request) {
+	type parameter struct {
+		Email string `json:"email"`
+	}
+	decoder := json.NewDecoder(req.Body)
+	param := parameter{}
+	err := decoder.Decode(&param)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Malformed JSON Request")
+		return
+	}
+
+	user, err := apiConfig.DB.GetUserByEmail(param.Email)
+	if err == nil {
+		apiConfig.sendEmailToken(user, auth.PasswordResetToken, "reset-password", "Reset your Chirpy password",
+			"Someone asked to reset the password of your Chirpy account. If it was you, open the link below within an hour. Otherwise you can ignore this email.")
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handlePasswordResetConfirm sets a new password given a reset token, and
+// logs the user out everywhere.
+func (apiConfig *apiConfig) handlePasswordResetConfirm(w http.ResponseWriter, req *http.Request) {
+	type parameter struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	decoder := json.NewDecoder(req.Body)
+	param := parameter{}
+	err := decoder.Decode(&param)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Malformed JSON Request")
+		return
+	}
+
+	token, email, ok := apiConfig.validateEmailToken(param.Token, auth.PasswordResetToken)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired token")
+		return
+	}
+	hashedPassword, ok := apiConfig.hashNewPassword(w, param.Password, email)
+	if !ok {
+		return
+	}
+	_, err = apiConfig.DB.ResetPassword(token, email, hashedPassword)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired token")
+		return
+	}
+	apiConfig.loginThrottle.unlock(email)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (apiConfig *apiConfig) handleVerifyEmail(w http.ResponseWriter, req *http.Request) {
+	type parameter struct {
+		Token string `json:"token"`
+	}
+	decoder := json.NewDecoder(req.Body)
+	param := parameter{}
+	err := decoder.Decode(&param)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Malformed JSON Request")
+		return
+	}
+
+	token, email, ok := apiConfig.validateEmailToken(param.Token, auth.VerifyEmailToken)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired token")
+		return
+	}
+	_, err = apiConfig.DB.VerifyEmail(token, email)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired token")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (apiConfig *apiConfig) handleResendVerification(w http.ResponseWriter, req *http.Request) {
+	user, err := apiConfig.DB.GetUser(requestIdentity(req).UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if user.EmailVerified {
+		respondWithError(w, http.StatusConflict, "Email already verified")
+		return
+	}
+	apiConfig.sendVerificationEmail(user)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (apiConfig *apiConfig) sendVerificationEmail(user database.User) {
+	apiConfig.sendEmailToken(user, auth.VerifyEmailToken, "verify-email", "Verify your Chirpy email",
+		"Open the link below within a day to confirm this is your email address.")
+}
+
+// sendEmailToken mails user a link to page on the app carrying a new token of
+// tokenType. The mail goes out in the background; failures are only logged.
+func (apiConfig *apiConfig) sendEmailToken(user database.User, tokenType string, page string, subject string, text string) {
+	token, err := auth.GenerateEmailToken(user.ID, user.Email, apiConfig.keys, tokenType)
+	if err != nil {
+		log.Printf("creating %s token: %v", tokenType, err)
+		return
+	}
+	link := fmt.Sprintf("%s/%s?token=%s", apiConfig.appURL, page, url.QueryEscape(token))
+	msg := mailer.Message{
+		To:      user.Email,
+		Subject: subject,
+		Body:    fmt.Sprintf("%s\n\n%s\n\nToken: %s\n", text, link, token),
+	}
+	go func() {
+		err := apiConfig.mailer.Send(msg)
+		if err != nil {
+			log.Printf("sending %s email: %v", tokenType, err)
+		}
+	}()
+}
+
+// validateEmailToken checks a mailed token and returns what the database
+// needs to spend it, along with the email it was sent to.
+func (apiConfig *apiConfig) validateEmailToken(tokenString string, tokenType string) (database.UsedToken, string, bool) {
+	userID, claims, err := auth.ValidateJWT(tokenString, apiConfig.keys, tokenType)
+	if err != nil || claims.ID == "" || claims.ExpiresAt == nil {
+		return database.UsedToken{}, "", false
+	}
+	return database.UsedToken{
+		ID:        claims.ID,
+		UserID:    userID,
+		ExpiresAt: claims.ExpiresAt.Time,
+	}, claims.Email, true
+}
+
+func (apiConfig *apiConfig) purgeUsedTokens() {
+	_, err := apiConfig.DB.PurgeUsedTokens(time.Now())
+	if err != nil {
+		log.Printf("purging used tokens: %v", err)
+	}
+}
@@ -0,0 +1,8 @@
+package main
+
+import "net/http"
+
+func (apiConfig *apiConfig) handleJWKS(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, http.StatusOK, apiConfig.keys.JWKS())
+}
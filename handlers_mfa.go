@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github/ntvviktor/GoServer/internal/auth"
+	"github/ntvviktor/GoServer/internal/database"
+	"net/http"
+	"time"
+)
+
+const totpIssuer = "Chirpy"
+
+var errInvalidCode = errors.New("invalid code")
+
+// handleLoginMFA finishes a login that authenticateUser answered with
+// mfa_required, given the mfa_token and either a TOTP code or a recovery code.
+func (apiConfig *apiConfig) handleLoginMFA(w http.ResponseWriter, req *http.Request) {
+	type parameter struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+		DeviceLabel  string `json:"device_label"`
+	}
+	decoder := json.NewDecoder(req.Body)
+	param := parameter{}
+	err := decoder.Decode(&param)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Malformed JSON Request")
+		return
+	}
+
+	userID, _, err := auth.ValidateJWT(param.MFAToken, apiConfig.keys, auth.MFAToken)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized MFA token")
+		return
+	}
+	authUser, err := apiConfig.DB.GetUser(userID)
+	if err != nil || !authUser.TOTPEnabled {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized MFA token")
+		return
+	}
+	ip := clientIP(req)
+	wait := apiConfig.loginThrottle.reserve(authUser.Email, ip)
+	if wait > 0 {
+		respondTooManyAttempts(w, wait)
+		return
+	}
+	err = apiConfig.checkSecondFactor(authUser, param.Code, param.RecoveryCode)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid code")
+		return
+	}
+	apiConfig.loginThrottle.release(authUser.Email, ip)
+	apiConfig.respondWithLogin(w, req, authUser, param.DeviceLabel)
+}
+
+// checkSecondFactor spends a TOTP code or, failing that, a recovery code of
+// user. Either can only be used once.
+func (apiConfig *apiConfig) checkSecondFactor(user database.User, code string, recoveryCode string) error {
+	if code != "" {
+		step, ok := auth.ValidateTOTP(user.TOTPSecret, code, time.Now())
+		if !ok {
+			return errInvalidCode
+		}
+		return apiConfig.DB.UseTOTPStep(user.ID, step)
+	}
+	if recoveryCode != "" {
+		return apiConfig.DB.UseRecoveryCode(user.ID, auth.HashRecoveryCode(recoveryCode))
+	}
+	return errInvalidCode
+}
+
+// handleEnrollTOTP hands out a fresh secret to add to an authenticator app.
+// TOTP stays off until handleConfirmTOTP sees a code for it.
+func (apiConfig *apiConfig) handleEnrollTOTP(w http.ResponseWriter, req *http.Request) {
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create TOTP secret")
+		return
+	}
+	user, err := apiConfig.DB.SetTOTPSecret(requestIdentity(req).UserID, secret)
+	if err != nil {
+		if errors.Is(err, database.ErrAlreadyExists) {
+			respondWithError(w, http.StatusConflict, "TOTP is already enabled")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't start TOTP enrolment")
+		return
+	}
+
+	type response struct {
+		Secret string `json:"secret"`
+		URI    string `json:"otpauth_uri"`
+	}
+	respondWithJSON(w, http.StatusOK, response{
+		Secret: secret,
+		URI:    auth.TOTPURI(secret, totpIssuer, user.Email),
+	})
+}
+
+// handleConfirmTOTP enables TOTP and answers with the recovery codes, which
+// are only ever shown here.
+func (apiConfig *apiConfig) handleConfirmTOTP(w http.ResponseWriter, req *http.Request) {
+	type parameter struct {
+		Code string `json:"code"`
+	}
+	decoder := json.NewDecoder(req.Body)
+	param := parameter{}
+	err := decoder.Decode(&param)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Malformed JSON Request")
+		return
+	}
+
+	user, err := apiConfig.DB.GetUser(requestIdentity(req).UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if user.TOTPEnabled {
+		respondWithError(w, http.StatusConflict, "TOTP is already enabled")
+		return
+	}
+	if user.TOTPSecret == "" {
+		respondWithError(w, http.StatusBadRequest, "TOTP enrolment not started")
+		return
+	}
+	step, ok := auth.ValidateTOTP(user.TOTPSecret, param.Code, time.Now())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Invalid code")
+		return
+	}
+	codes, hashes, err := auth.GenerateRecoveryCodes()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create recovery codes")
+		return
+	}
+	_, err = apiConfig.DB.ConfirmTOTP(user.ID, step, hashes)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't enable TOTP")
+		return
+	}
+
+	type response struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	respondWithJSON(w, http.StatusOK, response{
+		RecoveryCodes: codes,
+	})
+}
+
+// handleDisableTOTP turns TOTP off, given a current code or a recovery code.
+// Guesses count against the same throttle as logins.
+func (apiConfig *apiConfig) handleDisableTOTP(w http.ResponseWriter, req *http.Request) {
+	type parameter struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	decoder := json.NewDecoder(req.Body)
+	param := parameter{}
+	err := decoder.Decode(&param)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Malformed JSON Request")
+		return
+	}
+
+	user, err := apiConfig.DB.GetUser(requestIdentity(req).UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if !user.TOTPEnabled {
+		respondWithError(w, http.StatusBadRequest, "TOTP is not enabled")
+		return
+	}
+	ip := clientIP(req)
+	wait := apiConfig.loginThrottle.reserve(user.Email, ip)
+	if wait > 0 {
+		respondTooManyAttempts(w, wait)
+		return
+	}
+	err = apiConfig.checkSecondFactor(user, param.Code, param.RecoveryCode)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid code")
+		return
+	}
+	apiConfig.loginThrottle.release(user.Email, ip)
+	_, err = apiConfig.DB.DisableTOTP(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't disable TOTP")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github/ntvviktor/GoServer/internal/auth"
+	"github/ntvviktor/GoServer/internal/database"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type OAuthClient struct {
+	ID           string    `json:"client_id"`
+	Secret       string    `json:"client_secret,omitempty"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Confidential bool      `json:"confidential"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func newOAuthClientResponse(client database.OAuthClient) OAuthClient {
+	return OAuthClient{
+		ID:           client.ID,
+		Name:         client.Name,
+		RedirectURIs: client.RedirectURIs,
+		Confidential: client.SecretHash != "",
+		CreatedAt:    client.CreatedAt,
+	}
+}
+
+// handleCreateOAuthClient registers a third-party app owned by the caller.
+// The secret of a confidential client is only ever shown here.
+func (apiConfig *apiConfig) handleCreateOAuthClient(w http.ResponseWriter, req *http.Request) {
+	type parameter struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Confidential bool     `json:"confidential"`
+	}
+	decoder := json.NewDecoder(req.Body)
+	param := parameter{}
+	err := decoder.Decode(&param)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Malformed JSON Request")
+		return
+	}
+	if param.Name == "" || len(param.RedirectURIs) == 0 {
+		respondWithError(w, http.StatusBadRequest, "A name and at least one redirect URI are required")
+		return
+	}
+	for _, v := range param.RedirectURIs {
+		if !auth.ValidRedirectURI(v) {
+			respondWithError(w, http.StatusBadRequest, "Invalid redirect URI "+v)
+			return
+		}
+	}
+
+	clientID, err := auth.NewClientID()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create client")
+		return
+	}
+	secret, secretHash := "", ""
+	if param.Confidential {
+		secret, secretHash, err = auth.NewClientSecret()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create client")
+			return
+		}
+	}
+	client, err := apiConfig.DB.CreateOAuthClient(database.OAuthClient{
+		ID:           clientID,
+		SecretHash:   secretHash,
+		Name:         param.Name,
+		RedirectURIs: param.RedirectURIs,
+		OwnerID:      requestIdentity(req).UserID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create client")
+		return
+	}
+	response := newOAuthClientResponse(client)
+	response.Secret = secret
+	respondWithJSON(w, http.StatusCreated, response)
+}
+
+func (apiConfig *apiConfig) handleListOAuthClients(w http.ResponseWriter, req *http.Request) {
+	clients, err := apiConfig.DB.ListOAuthClients(requestIdentity(req).UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list clients")
+		return
+	}
+	response := make([]OAuthClient, 0, len(clients))
+	for _, v := range clients {
+		response = append(response, newOAuthClientResponse(v))
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// handleDeleteOAuthClient removes a client and cuts off every user who
+// granted it access.
+func (apiConfig *apiConfig) handleDeleteOAuthClient(w http.ResponseWriter, req *http.Request) {
+	err := apiConfig.DB.DeleteOAuthClient(chi.URLParam(req, "clientID"), requestIdentity(req).UserID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Client not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorizeRequest is a validated authorization request (RFC 6749 4.1.1)
+// with its PKCE challenge.
+type authorizeRequest struct {
+	Client        database.OAuthClient
+	RedirectURI   string
+	Scopes        []string
+	State         string
+	CodeChallenge string
+}
+
+// errBadClient is an authorization request that cannot be answered by
+// redirecting, because the client or redirect URI is not known to be good.
+var errBadClient = errors.New("unknown client or redirect URI")
+
+// parseAuthorizeRequest validates the authorization request parameters. An
+// error code is returned for problems to report to the client through its
+// redirect URI, errBadClient when there is no safe redirect URI.
+func (apiConfig *apiConfig) parseAuthorizeRequest(form url.Values) (authorizeRequest, string, error) {
+	client, err := apiConfig.DB.GetOAuthClient(form.Get("client_id"))
+	if err != nil {
+		return authorizeRequest{}, "", errBadClient
+	}
+	redirectURI := form.Get("redirect_uri")
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !slices.Contains(client.RedirectURIs, redirectURI) {
+		return authorizeRequest{}, "", errBadClient
+	}
+	authReq := authorizeRequest{
+		Client:        client,
+		RedirectURI:   redirectURI,
+		State:         form.Get("state"),
+		CodeChallenge: form.Get("code_challenge"),
+	}
+
+	if form.Get("response_type") != "code" {
+		return authReq, "unsupported_response_type", nil
+	}
+	if form.Get("code_challenge_method") != auth.PKCEMethodS256 || len(authReq.CodeChallenge) != 43 {
+		return authReq, "invalid_request", nil
+	}
+	authReq.Scopes, err = auth.ParseScope(form.Get("scope"), auth.GrantableScopes)
+	if err != nil {
+		return authReq, "invalid_scope", nil
+	}
+	return authReq, "", nil
+}
+
+// redirect sends the user agent back to the client with the given
+// parameters and the request's state.
+func (authReq authorizeRequest) redirect(w http.ResponseWriter, req *http.Request, params url.Values) {
+	u, err := url.Parse(authReq.RedirectURI)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid redirect URI")
+		return
+	}
+	query := u.Query()
+	for k, v := range params {
+		query[k] = v
+	}
+	if authReq.State != "" {
+		query.Set("state", authReq.State)
+	}
+	u.RawQuery = query.Encode()
+	http.Redirect(w, req, u.String(), http.StatusFound)
+}
+
+func (authReq authorizeRequest) redirectError(w http.ResponseWriter, req *http.Request, code string) {
+	authReq.redirect(w, req, url.Values{"error": {code}})
+}
+
+var consentTemplate = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Authorize {{.Client.Name}} - Chirpy</title></head>
+<body>
+	<h1>{{.Client.Name}} wants to access your Chirpy account</h1>
+	<p>It will be able to:</p>
+	<ul>
+		{{range .Scopes}}<li>{{index $.Descriptions .}}</li>{{end}}
+	</ul>
+	<p>You will be sent back to {{.RedirectURI}}.</p>
+	{{if .Error}}<p><strong>{{.Error}}</strong></p>{{end}}
+	<form method="post" action="/oauth/authorize">
+		{{range $k, $v := .Params}}<input type="hidden" name="{{$k}}" value="{{$v}}">
+		{{end}}
+		<p><label>Email <input type="email" name="email" value="{{.Email}}" required></label></p>
+		<p><label>Password <input type="password" name="password" required></label></p>
+		{{if .NeedsCode}}<p><label>Authenticator or recovery code <input type="text" name="code" autocomplete="one-time-code" required></label></p>{{end}}
+		<button type="submit" name="decision" value="allow">Allow</button>
+		<button type="submit" name="decision" value="deny" formnovalidate>Deny</button>
+	</form>
+</body>
+</html>
+`))
+
+var errorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Authorization failed - Chirpy</title></head>
+<body>
+	<h1>Authorization failed</h1>
+	<p>{{.}}</p>
+</body>
+</html>
+`))
+
+// renderConsent shows the consent screen for authReq. The user logs in on
+// the same form, since there is no cookie session to rely on.
+func renderConsent(w http.ResponseWriter, status int, authReq authorizeRequest, email string, needsCode bool, message string) {
+	params := map[string]string{
+		"response_type":         "code",
+		"client_id":             authReq.Client.ID,
+		"redirect_uri":          authReq.RedirectURI,
+		"scope":                 strings.Join(authReq.Scopes, " "),
+		"state":                 authReq.State,
+		"code_challenge":        authReq.CodeChallenge,
+		"code_challenge_method": auth.PKCEMethodS256,
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+	err := consentTemplate.Execute(w, map[string]any{
+		"Client":       authReq.Client,
+		"Scopes":       authReq.Scopes,
+		"Descriptions": auth.ScopeDescriptions,
+		"RedirectURI":  authReq.RedirectURI,
+		"Params":       params,
+		"Email":        email,
+		"NeedsCode":    needsCode,
+		"Error":        message,
+	})
+	if err != nil {
+		log.Printf("rendering consent screen: %v", err)
+	}
+}
+
+func renderAuthorizeError(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	errorTemplate.Execute(w, message)
+}
+
+// handleAuthorize is the authorization endpoint: it checks the request and
+// shows the consent screen.
+func (apiConfig *apiConfig) handleAuthorize(w http.ResponseWriter, req *http.Request) {
+	authReq, errCode, err := apiConfig.parseAuthorizeRequest(req.URL.Query())
+	if err != nil {
+		renderAuthorizeError(w, "The app sent an invalid authorization request.")
+		return
+	}
+	if errCode != "" {
+		authReq.redirectError(w, req, errCode)
+		return
+	}
+	renderConsent(w, http.StatusOK, authReq, "", false, "")
+}
+
+// handleAuthorizeDecision takes the submitted consent screen. On approval it
+// logs the user in and sends them back to the client with a code.
+func (apiConfig *apiConfig) handleAuthorizeDecision(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		renderAuthorizeError(w, "Malformed form.")
+		return
+	}
+	authReq, errCode, err := apiConfig.parseAuthorizeRequest(req.PostForm)
+	if err != nil {
+		renderAuthorizeError(w, "The app sent an invalid authorization request.")
+		return
+	}
+	if errCode != "" {
+		authReq.redirectError(w, req, errCode)
+		return
+	}
+	if req.PostForm.Get("decision") != "allow" {
+		authReq.redirectError(w, req, "access_denied")
+		return
+	}
+
+	email := req.PostForm.Get("email")
+	ip := clientIP(req)
+	user, err := apiConfig.checkPassword(email, req.PostForm.Get("password"), ip)
+	throttled := throttledError{}
+	switch {
+	case errors.As(err, &throttled):
+		renderConsent(w, http.StatusTooManyRequests, authReq, email, false, "Too many failed login attempts, try again later.")
+		return
+	case err != nil:
+		renderConsent(w, http.StatusUnauthorized, authReq, email, false, "Incorrect email or password.")
+		return
+	}
+	if user.TOTPEnabled {
+		code := req.PostForm.Get("code")
+		if code == "" {
+			renderConsent(w, http.StatusOK, authReq, email, true, "Enter a code from your authenticator app.")
+			return
+		}
+		recoveryCode := ""
+		if len(code) != 6 {
+			code, recoveryCode = "", code
+		}
+		if apiConfig.loginThrottle.reserve(user.Email, ip) > 0 {
+			renderConsent(w, http.StatusTooManyRequests, authReq, email, true, "Too many failed login attempts, try again later.")
+			return
+		}
+		err = apiConfig.checkSecondFactor(user, code, recoveryCode)
+		if err != nil {
+			renderConsent(w, http.StatusUnauthorized, authReq, email, true, "Invalid code.")
+			return
+		}
+		apiConfig.loginThrottle.release(user.Email, ip)
+	}
+	apiConfig.loginThrottle.unlock(user.Email)
+
+	code, codeHash, err := auth.NewAuthCode()
+	if err != nil {
+		authReq.redirectError(w, req, "server_error")
+		return
+	}
+	err = apiConfig.DB.CreateAuthCode(database.AuthCode{
+		Hash:          codeHash,
+		ClientID:      authReq.Client.ID,
+		UserID:        user.ID,
+		RedirectURI:   authReq.RedirectURI,
+		Scopes:        authReq.Scopes,
+		CodeChallenge: authReq.CodeChallenge,
+		ExpiresAt:     time.Now().Add(auth.AuthCodeTTL),
+	})
+	if err != nil {
+		authReq.redirectError(w, req, "server_error")
+		return
+	}
+	authReq.redirect(w, req, url.Values{"code": {code}})
+}
+
+// respondOAuthError answers the token, introspection and revocation
+// endpoints in the RFC 6749 5.2 error format.
+func respondOAuthError(w http.ResponseWriter, status int, code string, description string) {
+	type response struct {
+		Error       string `json:"error"`
+		Description string `json:"error_description,omitempty"`
+	}
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="chirpy"`)
+	}
+	respondWithJSON(w, status, response{
+		Error:       code,
+		Description: description,
+	})
+}
+
+var errInvalidClient = errors.New("invalid client")
+
+// authenticateClient identifies the calling client from HTTP Basic
+// credentials or client_id and client_secret form fields. Confidential
+// clients must present their secret; public clients only identify
+// themselves.
+func (apiConfig *apiConfig) authenticateClient(req *http.Request) (database.OAuthClient, error) {
+	clientID, secret, ok := req.BasicAuth()
+	if ok {
+		var err error
+		clientID, err = url.QueryUnescape(clientID)
+		if err != nil {
+			return database.OAuthClient{}, errInvalidClient
+		}
+		secret, err = url.QueryUnescape(secret)
+		if err != nil {
+			return database.OAuthClient{}, errInvalidClient
+		}
+	} else {
+		clientID = req.PostForm.Get("client_id")
+		secret = req.PostForm.Get("client_secret")
+	}
+	client, err := apiConfig.DB.GetOAuthClient(clientID)
+	if err != nil {
+		return database.OAuthClient{}, errInvalidClient
+	}
+	if client.SecretHash == "" {
+		if secret != "" {
+			return database.OAuthClient{}, errInvalidClient
+		}
+		return client, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(auth.HashToken(secret)), []byte(client.SecretHash)) != 1 {
+		return database.OAuthClient{}, errInvalidClient
+	}
+	return client, nil
+}
+
+var errInvalidGrant = errors.New("invalid grant")
+
+// handleToken is the token endpoint, for the authorization_code and
+// refresh_token grants.
+func (apiConfig *apiConfig) handleToken(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	err := req.ParseForm()
+	if err != nil {
+		respondOAuthError(w, http.StatusBadRequest, "invalid_request", "malformed form")
+		return
+	}
+	client, err := apiConfig.authenticateClient(req)
+	if err != nil {
+		respondOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+
+	refreshToken, refreshHash, err := auth.NewRefreshToken()
+	if err != nil {
+		respondOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	expiresAt := time.Now().Add(auth.RefreshTokenTTL)
+	var session database.Session
+	switch req.PostForm.Get("grant_type") {
+	case "authorization_code":
+		redirectURI := req.PostForm.Get("redirect_uri")
+		verifier := req.PostForm.Get("code_verifier")
+		session, err = apiConfig.DB.ExchangeAuthCode(auth.HashToken(req.PostForm.Get("code")), client.ID, func(code database.AuthCode) error {
+			if redirectURI != code.RedirectURI || !auth.VerifyPKCE(verifier, code.CodeChallenge) {
+				return errInvalidGrant
+			}
+			return nil
+		}, database.Session{
+			DeviceLabel: client.Name,
+			IP:          clientIP(req),
+			UserAgent:   req.UserAgent(),
+		}, refreshHash, expiresAt)
+		if errors.Is(err, database.ErrTokenReused) {
+			log.Printf("authorization code reused by client %s, session revoked", client.ID)
+		}
+	case "refresh_token":
+		oldHash := auth.HashToken(req.PostForm.Get("refresh_token"))
+		session, _, err = apiConfig.DB.GetSessionByToken(oldHash)
+		if err == nil && session.ClientID != client.ID {
+			err = errInvalidGrant
+		}
+		if err == nil {
+			session, err = apiConfig.DB.RotateRefreshToken(oldHash, refreshHash, expiresAt)
+		}
+	default:
+		respondOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+	if err != nil {
+		respondOAuthError(w, http.StatusBadRequest, "invalid_grant", "")
+		return
+	}
+
+	user, err := apiConfig.DB.GetUser(session.UserID)
+	if err != nil {
+		respondOAuthError(w, http.StatusBadRequest, "invalid_grant", "")
+		return
+	}
+	accessToken, err := apiConfig.issueAccessToken(user, session)
+	if err != nil {
+		respondOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	type response struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+		Scope        string `json:"scope"`
+	}
+	respondWithJSON(w, http.StatusOK, response{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(auth.AccessTokenTTL / time.Second),
+		RefreshToken: refreshToken,
+		Scope:        strings.Join(session.Scopes, " "),
+	})
+}
+
+// tokenSession finds the live session behind an access or refresh token
+// issued to client, along with the token's expiry and issue time where
+// known.
+func (apiConfig *apiConfig) tokenSession(token string, client database.OAuthClient) (database.Session, auth.Claims, bool) {
+	var session database.Session
+	userID, claims, err := auth.ValidateJWT(token, apiConfig.keys, auth.AccessToken)
+	if err == nil {
+		session, err = apiConfig.DB.GetSession(claims.SessionID)
+		if err == nil && session.UserID != userID {
+			err = errInvalidGrant
+		}
+	} else {
+		var refresh database.RefreshToken
+		session, refresh, err = apiConfig.DB.GetSessionByToken(auth.HashToken(token))
+		if err == nil && (refresh.UsedAt != nil || time.Now().After(refresh.ExpiresAt)) {
+			err = database.ErrExpired
+		}
+		claims = auth.Claims{}
+		claims.Subject = strconv.Itoa(session.UserID)
+		claims.ExpiresAt = jwt.NewNumericDate(refresh.ExpiresAt)
+	}
+	if err != nil || session.RevokedAt != nil || session.ClientID != client.ID {
+		return database.Session{}, auth.Claims{}, false
+	}
+	return session, claims, true
+}
+
+// handleIntrospect is RFC 7662 token introspection. Clients can only
+// introspect tokens issued to them; everything else is inactive.
+func (apiConfig *apiConfig) handleIntrospect(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	err := req.ParseForm()
+	if err != nil {
+		respondOAuthError(w, http.StatusBadRequest, "invalid_request", "malformed form")
+		return
+	}
+	client, err := apiConfig.authenticateClient(req)
+	if err != nil {
+		respondOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+
+	type response struct {
+		Active    bool   `json:"active"`
+		Scope     string `json:"scope,omitempty"`
+		ClientID  string `json:"client_id,omitempty"`
+		Subject   string `json:"sub,omitempty"`
+		ExpiresAt int64  `json:"exp,omitempty"`
+		IssuedAt  int64  `json:"iat,omitempty"`
+		Audience  string `json:"aud,omitempty"`
+		Issuer    string `json:"iss,omitempty"`
+	}
+	session, claims, ok := apiConfig.tokenSession(req.PostForm.Get("token"), client)
+	if !ok {
+		respondWithJSON(w, http.StatusOK, response{Active: false})
+		return
+	}
+	resp := response{
+		Active:   true,
+		Scope:    strings.Join(session.Scopes, " "),
+		ClientID: session.ClientID,
+		Subject:  claims.Subject,
+		Issuer:   claims.Issuer,
+	}
+	if claims.ExpiresAt != nil {
+		resp.ExpiresAt = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		resp.IssuedAt = claims.IssuedAt.Unix()
+	}
+	if len(claims.Audience) > 0 {
+		resp.Audience = claims.Audience[0]
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// handleRevokeOAuthToken is RFC 7009 token revocation. Revoking either an
+// access or a refresh token ends the whole grant. Unknown tokens are not an
+// error.
+func (apiConfig *apiConfig) handleRevokeOAuthToken(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		respondOAuthError(w, http.StatusBadRequest, "invalid_request", "malformed form")
+		return
+	}
+	client, err := apiConfig.authenticateClient(req)
+	if err != nil {
+		respondOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+	session, _, ok := apiConfig.tokenSession(req.PostForm.Get("token"), client)
+	if ok {
+		_, err = apiConfig.DB.RevokeSession(session.ID, session.UserID)
+		if err != nil && !errors.Is(err, database.ErrNotExist) {
+			respondOAuthError(w, http.StatusServiceUnavailable, "server_error", "")
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (apiConfig *apiConfig) purgeExpiredAuthCodes() {
+	_, err := apiConfig.DB.PurgeExpiredAuthCodes(time.Now())
+	if err != nil {
+		log.Printf("purging expired authorization codes: %v", err)
+	}
+}
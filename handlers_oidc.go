@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github/ntvviktor/GoServer/internal/auth"
+	"github/ntvviktor/GoServer/internal/database"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcStateCookie ties the callback to the browser that started the login,
+// so nobody can make a victim finish a login they started themselves.
+const oidcStateCookie = "oidc_state"
+
+// oidcLogins holds the logins on their way through the provider, keyed by
+// state. Like loginThrottle it lives in memory: a restart only makes users
+// in the middle of a login start over.
+type oidcLogins struct {
+	mux     sync.Mutex
+	pending map[string]oidcLogin
+}
+
+type oidcLogin struct {
+	nonce       string
+	verifier    string
+	deviceLabel string
+	// linkUserID is set when a logged in user is linking the identity to
+	// their account rather than logging in with it.
+	linkUserID int
+	expiresAt  time.Time
+}
+
+func newOIDCLogins() *oidcLogins {
+	return &oidcLogins{
+		pending: map[string]oidcLogin{},
+	}
+}
+
+func (l *oidcLogins) add(state string, login oidcLogin) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	login.expiresAt = time.Now().Add(auth.OIDCLoginTTL)
+	l.pending[state] = login
+}
+
+// take returns the login started with state. Each login can be finished
+// once.
+func (l *oidcLogins) take(state string) (oidcLogin, bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	login, ok := l.pending[state]
+	delete(l.pending, state)
+	if !ok || time.Now().After(login.expiresAt) {
+		return oidcLogin{}, false
+	}
+	return login, true
+}
+
+func (l *oidcLogins) prune() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	now := time.Now()
+	for k, v := range l.pending {
+		if now.After(v.expiresAt) {
+			delete(l.pending, k)
+		}
+	}
+}
+
+// startOIDCLogin remembers a new login and sets the state cookie, and
+// returns where to send the user.
+func (apiConfig *apiConfig) startOIDCLogin(w http.ResponseWriter, login oidcLogin) (string, error) {
+	state, nonce, verifier, err := auth.NewOIDCLogin()
+	if err != nil {
+		return "", err
+	}
+	login.nonce = nonce
+	login.verifier = verifier
+	apiConfig.oidcLogins.add(state, login)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/oidc/callback",
+		MaxAge:   int(auth.OIDCLoginTTL / time.Second),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(apiConfig.oidc.RedirectURL, "https:"),
+		// Lax, so the cookie comes along on the redirect back from the
+		// provider.
+		SameSite: http.SameSiteLaxMode,
+	})
+	return apiConfig.oidc.AuthCodeURL(state, nonce, verifier), nil
+}
+
+// handleOIDCLogin sends the user to log in at the provider.
+func (apiConfig *apiConfig) handleOIDCLogin(w http.ResponseWriter, req *http.Request) {
+	location, err := apiConfig.startOIDCLogin(w, oidcLogin{
+		deviceLabel: req.URL.Query().Get("device_label"),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't start login")
+		return
+	}
+	http.Redirect(w, req, location, http.StatusFound)
+}
+
+// handleOIDCLink starts linking an identity at the provider to the caller's
+// account. The caller's browser must then visit the returned URL.
+func (apiConfig *apiConfig) handleOIDCLink(w http.ResponseWriter, req *http.Request) {
+	location, err := apiConfig.startOIDCLogin(w, oidcLogin{
+		linkUserID: requestIdentity(req).UserID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't start linking")
+		return
+	}
+	type response struct {
+		AuthorizationURL string `json:"authorization_url"`
+	}
+	respondWithJSON(w, http.StatusOK, response{
+		AuthorizationURL: location,
+	})
+}
+
+// handleOIDCCallback is where the provider sends the user back. It verifies
+// the ID token and then either links the identity or logs its user in,
+// creating the user on the first login.
+func (apiConfig *apiConfig) handleOIDCCallback(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	cookie, err := req.Cookie(oidcStateCookie)
+	if err != nil || cookie.Value != query.Get("state") {
+		respondWithError(w, http.StatusBadRequest, "Invalid login state")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   oidcStateCookie,
+		Path:   "/api/oidc/callback",
+		MaxAge: -1,
+	})
+	login, ok := apiConfig.oidcLogins.take(cookie.Value)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Login expired, please start over")
+		return
+	}
+	if errCode := query.Get("error"); errCode != "" {
+		respondWithError(w, http.StatusUnauthorized, "Login at the provider failed: "+errCode)
+		return
+	}
+
+	identity, err := apiConfig.oidc.Exchange(req.Context(), query.Get("code"), login.verifier, login.nonce)
+	if err != nil {
+		log.Printf("OIDC login: %v", err)
+		respondWithError(w, http.StatusUnauthorized, "Couldn't verify the login at the provider")
+		return
+	}
+	link := database.Identity{
+		Issuer:  identity.Issuer,
+		Subject: identity.Subject,
+		UserID:  login.linkUserID,
+		Email:   identity.Email,
+	}
+
+	if login.linkUserID != 0 {
+		linked, err := apiConfig.DB.LinkIdentity(link)
+		if err != nil {
+			if errors.Is(err, database.ErrAlreadyExists) {
+				respondWithError(w, http.StatusConflict, "This identity is linked to another account")
+				return
+			}
+			respondWithError(w, http.StatusInternalServerError, "Couldn't link identity")
+			return
+		}
+		respondWithJSON(w, http.StatusOK, newIdentityResponse(linked))
+		return
+	}
+
+	user, err := apiConfig.identityUser(identity, link)
+	if err != nil {
+		switch {
+		case errors.Is(err, errUnverifiedEmail):
+			respondWithError(w, http.StatusForbidden, "The provider did not verify your email address")
+		case errors.Is(err, database.ErrAlreadyExists):
+			respondWithError(w, http.StatusConflict, "An account with this email already exists, log in and link the provider to it")
+		default:
+			respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
+		}
+		return
+	}
+	apiConfig.completeLogin(w, req, user, login.deviceLabel)
+}
+
+var errUnverifiedEmail = errors.New("email not verified by provider")
+
+// identityUser finds the user an identity logs in as. An identity seen for
+// the first time is linked to the account with its email only if both the
+// provider and the account verified that email; without an account it gets
+// a new one.
+func (apiConfig *apiConfig) identityUser(identity auth.OIDCIdentity, link database.Identity) (database.User, error) {
+	linked, err := apiConfig.DB.GetIdentity(identity.Issuer, identity.Subject)
+	if err == nil {
+		return apiConfig.DB.GetUser(linked.UserID)
+	}
+	if !errors.Is(err, database.ErrNotExist) {
+		return database.User{}, err
+	}
+	if identity.Email == "" || !identity.EmailVerified {
+		return database.User{}, errUnverifiedEmail
+	}
+
+	user, err := apiConfig.DB.GetUserByEmail(identity.Email)
+	if errors.Is(err, database.ErrNotExist) {
+		return apiConfig.DB.CreateIdentityUser(identity.Email, link)
+	}
+	if err != nil {
+		return database.User{}, err
+	}
+	if !user.EmailVerified {
+		return database.User{}, database.ErrAlreadyExists
+	}
+	link.UserID = user.ID
+	_, err = apiConfig.DB.LinkIdentity(link)
+	if err != nil {
+		return database.User{}, err
+	}
+	return user, nil
+}
+
+type Identity struct {
+	Issuer   string    `json:"issuer"`
+	Subject  string    `json:"subject"`
+	Email    string    `json:"email"`
+	LinkedAt time.Time `json:"linked_at"`
+}
+
+func newIdentityResponse(identity database.Identity) Identity {
+	return Identity{
+		Issuer:   identity.Issuer,
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+		LinkedAt: identity.LinkedAt,
+	}
+}
+
+func (apiConfig *apiConfig) handleListIdentities(w http.ResponseWriter, req *http.Request) {
+	identities, err := apiConfig.DB.ListIdentities(requestIdentity(req).UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list identities")
+		return
+	}
+	response := make([]Identity, 0, len(identities))
+	for _, v := range identities {
+		response = append(response, newIdentityResponse(v))
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// handleUnlinkIdentity removes a linked identity. A user without a password
+// cannot remove the last one.
+func (apiConfig *apiConfig) handleUnlinkIdentity(w http.ResponseWriter, req *http.Request) {
+	type parameter struct {
+		Issuer  string `json:"issuer"`
+		Subject string `json:"subject"`
+	}
+	decoder := json.NewDecoder(req.Body)
+	param := parameter{}
+	err := decoder.Decode(&param)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Malformed JSON Request")
+		return
+	}
+	err = apiConfig.DB.UnlinkIdentity(param.Issuer, param.Subject, requestIdentity(req).UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrNotExist):
+			respondWithError(w, http.StatusNotFound, "Identity not found")
+		case errors.Is(err, database.ErrLastLogin):
+			respondWithError(w, http.StatusConflict, "Set a password before unlinking your last identity")
+		default:
+			respondWithError(w, http.StatusInternalServerError, "Couldn't unlink identity")
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github/ntvviktor/GoServer/internal/database"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var handlePattern = regexp.MustCompile(`^[A-Za-z0-9_]{3,30}$`)
+
+// reservedHandles could pass for the site itself, or clash with routes such
+// as /api/users/me.
+var reservedHandles = []string{"admin", "api", "chirpy", "deleted", "me", "moderator", "root", "support", "verify"}
+
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 160
+	maxAvatarURLLength   = 2048
+)
+
+// normalizeHandle drops the @ a handle may be written with.
+func normalizeHandle(handle string) string {
+	return strings.TrimPrefix(strings.TrimSpace(handle), "@")
+}
+
+// validateProfile checks the profile fields of a user update and sets the
+// ones present on update, cleaned up. On failure it has already responded.
+func validateProfile(w http.ResponseWriter, update *database.UserUpdate, handle *string, displayName *string, bio *string, avatarURL *string) bool {
+	if handle != nil {
+		v := normalizeHandle(*handle)
+		if !handlePattern.MatchString(v) {
+			respondWithError(w, http.StatusBadRequest, "Handle must be 3 to 30 letters, digits or underscores")
+			return false
+		}
+		if slices.Contains(reservedHandles, strings.ToLower(v)) {
+			respondWithError(w, http.StatusBadRequest, "Handle is reserved")
+			return false
+		}
+		update.Handle = &v
+	}
+	if displayName != nil {
+		v := strings.TrimSpace(*displayName)
+		if utf8.RuneCountInString(v) > maxDisplayNameLength || strings.ContainsFunc(v, unicode.IsControl) {
+			respondWithError(w, http.StatusBadRequest, "Display name must be at most 50 characters on one line")
+			return false
+		}
+		update.DisplayName = &v
+	}
+	if bio != nil {
+		v := strings.TrimSpace(*bio)
+		if utf8.RuneCountInString(v) > maxBioLength {
+			respondWithError(w, http.StatusBadRequest, "Bio must be at most 160 characters")
+			return false
+		}
+		if strings.ContainsFunc(v, func(r rune) bool { return unicode.IsControl(r) && r != '\n' }) {
+			respondWithError(w, http.StatusBadRequest, "Bio contains invalid characters")
+			return false
+		}
+		update.Bio = &v
+	}
+	if avatarURL != nil {
+		v := strings.TrimSpace(*avatarURL)
+		if v != "" {
+			u, err := url.Parse(v)
+			if err != nil || u.Scheme != "https" || u.Host == "" || len(v) > maxAvatarURLLength {
+				respondWithError(w, http.StatusBadRequest, "Avatar URL must be an https URL")
+				return false
+			}
+		}
+		update.AvatarURL = &v
+	}
+	return true
+}
+
+type Profile struct {
+	ID          int    `json:"id"`
+	Handle      string `json:"handle"`
+	DisplayName string `json:"display_name"`
+	Bio         string `json:"bio"`
+	AvatarURL   string `json:"avatar_url"`
+}
+
+// handleGetProfile shows the public profile of the user with a handle. It
+// never reveals the email address.
+func (apiConfig *apiConfig) handleGetProfile(w http.ResponseWriter, req *http.Request) {
+	user, err := apiConfig.DB.GetUserByHandle(normalizeHandle(chi.URLParam(req, "handle")))
+	if err != nil {
+		if errors.Is(err, database.ErrNotExist) {
+			respondWithError(w, http.StatusNotFound, "User not found")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, Profile{
+		ID:          user.ID,
+		Handle:      user.Handle,
+		DisplayName: user.DisplayName,
+		Bio:         user.Bio,
+		AvatarURL:   user.AvatarURL,
+	})
+}
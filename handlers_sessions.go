@@ -0,0 +1,81 @@
+package main
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github/ntvviktor/GoServer/internal/database"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type Session struct {
+	ID          int       `json:"id"`
+	DeviceLabel string    `json:"device_label"`
+	IP          string    `json:"ip"`
+	UserAgent   string    `json:"user_agent"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+	Current     bool      `json:"current"`
+	// ClientID names the OAuth client the session was granted to, if any.
+	ClientID string `json:"client_id,omitempty"`
+}
+
+func newSessionResponse(session database.Session, currentID int) Session {
+	return Session{
+		ID:          session.ID,
+		DeviceLabel: session.DeviceLabel,
+		IP:          session.IP,
+		UserAgent:   session.UserAgent,
+		CreatedAt:   session.CreatedAt,
+		LastSeenAt:  session.LastSeenAt,
+		Current:     session.ID == currentID,
+		ClientID:    session.ClientID,
+	}
+}
+
+func (apiConfig *apiConfig) handleListSessions(w http.ResponseWriter, req *http.Request) {
+	caller := requestIdentity(req)
+	sessions, err := apiConfig.DB.ListSessions(caller.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list sessions")
+		return
+	}
+
+	response := make([]Session, 0, len(sessions))
+	for _, v := range sessions {
+		if seen, ok := apiConfig.activity.session(v.ID); ok {
+			v.LastSeenAt, v.IP = seen.At, seen.IP
+		}
+		response = append(response, newSessionResponse(v, caller.SessionID))
+	}
+	sort.Slice(response, func(i, j int) bool {
+		return response[i].LastSeenAt.After(response[j].LastSeenAt)
+	})
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+func (apiConfig *apiConfig) handleRevokeSession(w http.ResponseWriter, req *http.Request) {
+	sessionID, err := strconv.Atoi(chi.URLParam(req, "sessionID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Malformed URL request")
+		return
+	}
+	_, err = apiConfig.DB.RevokeSession(sessionID, requestIdentity(req).UserID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleLogoutAll revokes every session of the caller, the current one
+// included.
+func (apiConfig *apiConfig) handleLogoutAll(w http.ResponseWriter, req *http.Request) {
+	_, err := apiConfig.DB.RevokeAllSessions(requestIdentity(req).UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke sessions")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
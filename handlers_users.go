@@ -3,10 +3,11 @@ package main
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"github/ntvviktor/GoServer/internal/auth"
 	"github/ntvviktor/GoServer/internal/database"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -18,6 +19,7 @@ type User struct {
 	AccessToken  string `json:"token"`
 	RefreshToken string `json:"refresh_token"`
 	IsChirpyRed  bool   `json:"is_chirpy_red"`
+	Role         string `json:"role"`
 }
 
 func (apiConfig *apiConfig) createUser(w http.ResponseWriter, req *http.Request) {
@@ -39,7 +41,10 @@ func (apiConfig *apiConfig) createUser(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	hashedPassword, _ := auth.HashUserPassword(param.Password)
+	hashedPassword, ok := apiConfig.hashNewPassword(w, param.Password, param.Email)
+	if !ok {
+		return
+	}
 	user, err := apiConfig.DB.CreateUser(param.Email, hashedPassword)
 	if err != nil {
 		if errors.Is(err, database.ErrAlreadyExists) {
@@ -49,6 +54,7 @@ func (apiConfig *apiConfig) createUser(w http.ResponseWriter, req *http.Request)
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create user")
 		return
 	}
+	apiConfig.sendVerificationEmail(user)
 
 	respondWithJSON(w, 201, response{
 		ID:    user.ID,
@@ -62,9 +68,7 @@ func (apiConfig *apiConfig) authenticateUser(w http.ResponseWriter, req *http.Re
 		Email       string `json:"email"`
 		Password    string `json:"password"`
 		ExpiresTime int    `json:"expires_in_seconds"`
-	}
-	type response struct {
-		User
+		DeviceLabel string `json:"device_label"`
 	}
 
 	decoder := json.NewDecoder(req.Body)
@@ -75,107 +79,344 @@ func (apiConfig *apiConfig) authenticateUser(w http.ResponseWriter, req *http.Re
 		return
 	}
 
-	authUser, err := apiConfig.DB.GetUserByEmail(param.Email)
+	authUser, err := apiConfig.checkPassword(param.Email, param.Password, clientIP(req))
 	if err != nil {
-		if errors.Is(err, database.ErrNotExist) {
-			respondWithError(w, http.StatusNotFound, "User not found!")
+		respondLoginError(w, err)
+		return
+	}
+	apiConfig.completeLogin(w, req, authUser, param.DeviceLabel)
+}
+
+// completeLogin follows the first factor of a login: it asks for the second
+// factor if the user has one, and logs them in otherwise.
+func (apiConfig *apiConfig) completeLogin(w http.ResponseWriter, req *http.Request, authUser database.User, deviceLabel string) {
+	if authUser.TOTPEnabled {
+		mfaToken, err := auth.GenerateJWT(authUser.ID, 0, "", nil, apiConfig.keys, auth.MFAToken)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Error creating JWT token")
 			return
 		}
-		http.Error(w, "Internal Error", 500)
+		type mfaResponse struct {
+			MFARequired bool   `json:"mfa_required"`
+			MFAToken    string `json:"mfa_token"`
+		}
+		respondWithJSON(w, http.StatusOK, mfaResponse{
+			MFARequired: true,
+			MFAToken:    mfaToken,
+		})
 		return
 	}
-	err = auth.AuthenticateUser(param.Password, authUser.Password)
+	apiConfig.respondWithLogin(w, req, authUser, deviceLabel)
+}
+
+// issueAccessToken mints an access token for a session of user. Sessions
+// granted to an OAuth client are limited to the scopes the user consented
+// to; logins get every scope of the user's role.
+func (apiConfig *apiConfig) issueAccessToken(user database.User, session database.Session) (string, error) {
+	scopes := roleScopes(user.Role)
+	if session.ClientID != "" {
+		scopes = session.Scopes
+	}
+	return auth.GenerateJWT(user.ID, session.ID, user.Role, scopes, apiConfig.keys, auth.AccessToken)
+}
+
+var errBadCredentials = errors.New("incorrect email or password")
+
+// throttledError refuses a login attempt without looking at the credentials.
+type throttledError struct {
+	wait time.Duration
+}
+
+func (e throttledError) Error() string {
+	return "too many failed login attempts"
+}
+
+// checkPassword is the password step of every login, throttled per account
+// and client address. It fails with errBadCredentials whether or not the
+// email exists, taking the same time either way, or with a throttledError.
+func (apiConfig *apiConfig) checkPassword(email string, password string, ip string) (database.User, error) {
+	wait := apiConfig.loginThrottle.reserve(email, ip)
+	if wait > 0 {
+		return database.User{}, throttledError{wait: wait}
+	}
+	authUser, err := apiConfig.DB.GetUserByEmail(email)
+	if err == nil && authUser.Password == "" {
+		// Accounts that only log in through a provider have no password to
+		// check; they fail like an unknown email, taking as long.
+		err = database.ErrNotExist
+	}
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Wrong Password")
-		return
+		if !errors.Is(err, database.ErrNotExist) {
+			return database.User{}, err
+		}
+		auth.AuthenticateNobody(password, apiConfig.hashParams)
+	} else {
+		var outdated bool
+		outdated, err = auth.AuthenticateUser(password, authUser.Password, apiConfig.hashParams)
+		if err == nil && outdated {
+			apiConfig.upgradePasswordHash(authUser, password)
+		}
+	}
+	if err != nil {
+		return database.User{}, errBadCredentials
+	}
+	apiConfig.loginThrottle.release(email, ip)
+	return authUser, nil
+}
+
+func respondLoginError(w http.ResponseWriter, err error) {
+	throttled := throttledError{}
+	switch {
+	case errors.As(err, &throttled):
+		respondTooManyAttempts(w, throttled.wait)
+	case errors.Is(err, errBadCredentials):
+		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password")
+	default:
+		respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
 	}
-	accessToken, err := auth.GenerateJWT(authUser.ID, apiConfig.jwtSecret, auth.AccessToken)
-	refreshToken, err := auth.GenerateJWT(authUser.ID, apiConfig.jwtSecret, auth.RefreshToken)
+}
 
+// respondWithLogin opens a new session for user and answers with its access
+// and refresh tokens. It is the last step of every successful login.
+func (apiConfig *apiConfig) respondWithLogin(w http.ResponseWriter, req *http.Request, authUser database.User, deviceLabel string) {
+	apiConfig.loginThrottle.unlock(authUser.Email)
+	refreshToken, refreshHash, err := auth.NewRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error creating refresh token")
+		return
+	}
+	session, err := apiConfig.DB.CreateSession(database.Session{
+		UserID:      authUser.ID,
+		DeviceLabel: deviceLabel,
+		IP:          clientIP(req),
+		UserAgent:   req.UserAgent(),
+	}, refreshHash, time.Now().Add(auth.RefreshTokenTTL))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error creating session")
+		return
+	}
+	accessToken, err := apiConfig.issueAccessToken(authUser, session)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Error creating JWT token")
 		return
 	}
-	respondWithJSON(w, http.StatusOK, response{
-		User{
-			ID:           authUser.ID,
-			Email:        authUser.Email,
-			IsChirpyRed:  authUser.IsChirpyRed,
-			AccessToken:  accessToken,
-			RefreshToken: refreshToken,
-		},
+	respondWithJSON(w, http.StatusOK, User{
+		ID:           authUser.ID,
+		Email:        authUser.Email,
+		IsChirpyRed:  authUser.IsChirpyRed,
+		Role:         authUser.Role,
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
 	})
 }
 
-func (apiConfig *apiConfig) validateUser(w http.ResponseWriter, req *http.Request) {
-	tokenString, canCut := getTokenFromHeader(req)
-	if !canCut {
-		respondWithError(w, http.StatusUnauthorized, "Malformed request token string")
-		return
+// hashNewPassword checks a password a user picked for the account with the
+// given email against the policy and hashes it. On failure it has already
+// responded, listing every broken rule if the policy refused the password.
+func (apiConfig *apiConfig) hashNewPassword(w http.ResponseWriter, password string, email string) (string, bool) {
+	err := apiConfig.passwordPolicy.Check(password, email)
+	policyErr := &auth.PolicyError{}
+	if errors.As(err, &policyErr) {
+		type response struct {
+			Error      string                 `json:"error"`
+			Violations []auth.PolicyViolation `json:"violations"`
+		}
+		respondWithJSON(w, http.StatusUnprocessableEntity, response{
+			Error:      "Password does not meet the password policy",
+			Violations: policyErr.Violations,
+		})
+		return "", false
 	}
+	if err != nil {
+		log.Printf("checking password policy: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
+		return "", false
+	}
+	hashedPassword, err := auth.HashUserPassword(password, apiConfig.hashParams)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
+		return "", false
+	}
+	return hashedPassword, true
+}
+
+// upgradePasswordHash stores a hash of password made with the current
+// parameters. The login goes ahead even if that fails.
+func (apiConfig *apiConfig) upgradePasswordHash(user database.User, password string) {
+	hashedPassword, err := auth.HashUserPassword(password, apiConfig.hashParams)
+	if err == nil {
+		err = apiConfig.DB.UpgradePasswordHash(user.ID, user.Password, hashedPassword)
+	}
+	if err != nil {
+		log.Printf("upgrading password hash of user %d: %v", user.ID, err)
+	}
+}
+
+// respondTooManyAttempts refuses a throttled login without looking at the
+// credentials.
+func respondTooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+	respondWithError(w, http.StatusTooManyRequests, "Too many failed login attempts, try again later")
+}
 
+// handleUpdateMe changes the fields of the caller's account present in the
+// request and leaves the rest alone. Changing the email or password takes
+// the current password, and a new password logs out every other session.
+func (apiConfig *apiConfig) handleUpdateMe(w http.ResponseWriter, req *http.Request) {
 	type parameter struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email           *string `json:"email"`
+		Password        *string `json:"password"`
+		CurrentPassword string  `json:"current_password"`
+		Handle          *string `json:"handle"`
+		DisplayName     *string `json:"display_name"`
+		Bio             *string `json:"bio"`
+		AvatarURL       *string `json:"avatar_url"`
 	}
 	param := parameter{}
 	decoder := json.NewDecoder(req.Body)
 	err := decoder.Decode(&param)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Malformed request, token is not valid!")
+		respondWithError(w, http.StatusBadRequest, "Malformed JSON Request")
 		return
 	}
 
-	validID, issuer, err := auth.ValidateJWT(tokenString, apiConfig.jwtSecret)
-	if err != nil || issuer == "chirpy-refresh" {
-		respondWithError(w, http.StatusUnauthorized, "Cannot validate token")
+	caller := requestIdentity(req)
+	user, err := apiConfig.DB.GetUser(caller.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
 		return
 	}
+	if (param.Email != nil || param.Password != nil) && !apiConfig.reauthenticate(w, req, user, param.CurrentPassword) {
+		return
+	}
+	update := database.UserUpdate{
+		Email:         param.Email,
+		KeepSessionID: caller.SessionID,
+	}
+	if !validateProfile(w, &update, param.Handle, param.DisplayName, param.Bio, param.AvatarURL) {
+		return
+	}
+	if param.Email != nil && *param.Email == "" {
+		respondWithError(w, http.StatusBadRequest, "Email cannot be empty")
+		return
+	}
+	if param.Password != nil {
+		email := user.Email
+		if param.Email != nil {
+			email = *param.Email
+		}
+		hashedPassword, ok := apiConfig.hashNewPassword(w, *param.Password, email)
+		if !ok {
+			return
+		}
+		update.Password = &hashedPassword
+	}
 
-	hashedPassword, err := auth.HashUserPassword(param.Password)
-	user, err := apiConfig.DB.UpdateUser(validID, param.Email, hashedPassword)
-
+	user, err = apiConfig.DB.UpdateUser(caller.UserID, update)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
+		switch {
+		case errors.Is(err, database.ErrAlreadyExists):
+			respondWithError(w, http.StatusConflict, "User already exists")
+		case errors.Is(err, database.ErrHandleTaken):
+			respondWithError(w, http.StatusConflict, "Handle is taken")
+		default:
+			respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
+		}
+		return
 	}
+	if param.Email != nil && !user.EmailVerified {
+		apiConfig.sendVerificationEmail(user)
+	}
+	respondWithJSON(w, http.StatusOK, newMeResponse(user))
+}
 
-	type response struct {
-		Email string `json:"email"`
-		ID    int    `json:"id"`
+type Me struct {
+	ID            int    `json:"id"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	IsChirpyRed   bool   `json:"is_chirpy_red"`
+	Role          string `json:"role"`
+	TOTPEnabled   bool   `json:"totp_enabled"`
+	Handle        string `json:"handle"`
+	DisplayName   string `json:"display_name"`
+	Bio           string `json:"bio"`
+	AvatarURL     string `json:"avatar_url"`
+}
+
+func newMeResponse(user database.User) Me {
+	return Me{
+		ID:            user.ID,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		IsChirpyRed:   user.IsChirpyRed,
+		Role:          user.Role,
+		TOTPEnabled:   user.TOTPEnabled,
+		Handle:        user.Handle,
+		DisplayName:   user.DisplayName,
+		Bio:           user.Bio,
+		AvatarURL:     user.AvatarURL,
 	}
-	respondWithJSON(w, 200, response{
-		Email: user.Email,
-		ID:    user.ID,
-	})
 }
 
+// handleGetMe describes the caller's account.
+func (apiConfig *apiConfig) handleGetMe(w http.ResponseWriter, req *http.Request) {
+	user, err := apiConfig.DB.GetUser(requestIdentity(req).UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, newMeResponse(user))
+}
+
+// postRefreshToken spends the presented refresh token and answers with a new
+// access token and a new refresh token. A token that was already spent
+// revokes its whole session.
 func (apiConfig *apiConfig) postRefreshToken(w http.ResponseWriter, req *http.Request) {
 	tokenString, canCut := getTokenFromHeader(req)
 	if !canCut {
 		respondWithError(w, http.StatusUnauthorized, "Malformed request token string")
 		return
 	}
-	validID, issuer, err := auth.ValidateJWT(tokenString, apiConfig.jwtSecret)
-	if err != nil || issuer != "chirpy-refresh" {
-		respondWithError(w, http.StatusUnauthorized, "Unauthorized JSON Token")
+	refreshToken, refreshHash, err := auth.NewRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error creating refresh token")
 		return
 	}
-
-	user, err := apiConfig.DB.GetUser(validID)
-	if err != nil || issuer != "chirpy-refresh" {
-		respondWithError(w, http.StatusNotFound, "User Not found")
+	oldHash := auth.HashToken(tokenString)
+	session, _, err := apiConfig.DB.GetSessionByToken(oldHash)
+	if err == nil && session.ClientID != "" {
+		// Tokens granted to an OAuth client are only refreshed at
+		// /oauth/token, where the client has to authenticate.
+		err = errInvalidGrant
+	}
+	if err == nil {
+		session, err = apiConfig.DB.RotateRefreshToken(oldHash, refreshHash, time.Now().Add(auth.RefreshTokenTTL))
+	}
+	if err != nil {
+		if errors.Is(err, database.ErrTokenReused) {
+			log.Printf("refresh token reused, session revoked")
+		}
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized refresh token")
 		return
 	}
-	if user.RevokeToken.ID != "" {
-		respondWithError(w, http.StatusUnauthorized, "Unauthorized JSON Token")
+	user, err := apiConfig.DB.GetUser(session.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized refresh token")
+		return
+	}
+	accessToken, err := apiConfig.issueAccessToken(user, session)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error creating JWT token")
 		return
 	}
 
 	type response struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}
 	respondWithJSON(w, 200, response{
-		Token: tokenString,
+		Token:        accessToken,
+		RefreshToken: refreshToken,
 	})
 }
 
@@ -185,26 +426,23 @@ func (apiConfig *apiConfig) postRevokeToken(w http.ResponseWriter, req *http.Req
 		respondWithError(w, http.StatusUnauthorized, "Malformed request token string")
 		return
 	}
-	validID, issuer, err := auth.ValidateJWT(tokenString, apiConfig.jwtSecret)
-
-	if err != nil || issuer != "chirpy-refresh" {
-		respondWithError(w, http.StatusUnauthorized, "Unauthorized JSON Token")
+	_, err := apiConfig.DB.RevokeSessionByToken(auth.HashToken(tokenString))
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized refresh token")
 		return
 	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	user, err := apiConfig.DB.CreateRevokeToken(validID, time.Now(), tokenString)
-	if err != nil || issuer != "chirpy-refresh" {
-		respondWithError(w, http.StatusNotFound, "User Not found")
-		return
+func (apiConfig *apiConfig) purgeExpiredSessions() {
+	_, err := apiConfig.DB.PurgeExpiredSessions(time.Now())
+	if err != nil {
+		log.Printf("purging expired sessions: %v", err)
 	}
-
-	respondWithJSON(w, 200, user.Email)
 }
 
 func getTokenFromHeader(req *http.Request) (string, bool) {
 	authorizedToken := req.Header.Get("Authorization")
 	tokenString, canCut := strings.CutPrefix(authorizedToken, "Bearer ")
-	fmt.Println(tokenString)
-
 	return tokenString, canCut
 }
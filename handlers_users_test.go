@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"github/ntvviktor/GoServer/internal/auth"
+	"github/ntvviktor/GoServer/internal/database"
+	"testing"
+	"time"
+)
+
+// An account without a password must fail the password step like an unknown
+// email does, in about as long, so timing does not tell them apart.
+func TestCheckPasswordWithoutPassword(t *testing.T) {
+	db := database.NewMemoryDB()
+	_, err := db.CreateIdentityUser("alice@example.com", database.Identity{Issuer: "https://idp.example", Subject: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiConfig := &apiConfig{
+		DB:            db,
+		loginThrottle: newLoginThrottle(),
+		hashParams:    auth.DefaultHashParams(),
+	}
+	// The first call makes the dummy hash, which takes as long as a check.
+	apiConfig.checkPassword("nobody@example.com", "good passphrase", "192.0.2.1")
+
+	elapsed := func(email string) time.Duration {
+		start := time.Now()
+		_, err := apiConfig.checkPassword(email, "good passphrase", "192.0.2.1")
+		if !errors.Is(err, errBadCredentials) {
+			t.Errorf("checkPassword(%q): err = %v, want errBadCredentials", email, err)
+		}
+		return time.Since(start)
+	}
+	unknown := elapsed("nobody@example.com")
+	passwordless := elapsed("alice@example.com")
+	if passwordless < unknown/2 {
+		t.Errorf("passwordless account failed in %v, unknown email in %v", passwordless, unknown)
+	}
+}
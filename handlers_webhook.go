@@ -1,17 +1,17 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
-	"fmt"
+	"github/ntvviktor/GoServer/internal/auth"
+	"github/ntvviktor/GoServer/internal/database"
 	"net/http"
+	"slices"
 	"strings"
 )
 
 func (apiConfig *apiConfig) handleWebhook(w http.ResponseWriter, req *http.Request) {
-	apiString := req.Header.Get("Authorization")
-	apiKey, canCut := strings.CutPrefix(apiString, "ApiKey ")
-	fmt.Println(apiKey)
-	if !canCut || apiKey != apiConfig.apiKey {
+	if !apiConfig.authorizeAPIKey(req) {
 		respondWithError(w, http.StatusUnauthorized, "Unauthorized request")
 		return
 	}
@@ -35,9 +35,34 @@ func (apiConfig *apiConfig) handleWebhook(w http.ResponseWriter, req *http.Reque
 			respondWithError(w, http.StatusNotFound, "User not found")
 			return
 		}
-		respondWithJSON(w, http.StatusOK, user)
+		type response struct {
+			ID          int  `json:"id"`
+			IsChirpyRed bool `json:"is_chirpy_red"`
+		}
+		respondWithJSON(w, http.StatusOK, response{
+			ID:          user.ID,
+			IsChirpyRed: user.IsChirpyRed,
+		})
 		return
 	}
 	respondWithJSON(w, http.StatusOK, "")
 	return
 }
+
+// authorizeAPIKey accepts the shared API_KEY given to the payment provider,
+// or a personal API key of an admin.
+func (apiConfig *apiConfig) authorizeAPIKey(req *http.Request) bool {
+	apiKey, canCut := getAPIKeyFromHeader(req)
+	if !canCut {
+		return false
+	}
+	if apiConfig.apiKey != "" && subtle.ConstantTimeCompare([]byte(apiKey), []byte(apiConfig.apiKey)) == 1 {
+		return true
+	}
+	caller, err := apiConfig.apiKeyIdentity(apiKey)
+	return err == nil && hasRole(caller.Role, database.RoleAdmin) && slices.Contains(caller.Scopes, auth.ScopeAdmin)
+}
+
+func getAPIKeyFromHeader(req *http.Request) (string, bool) {
+	return strings.CutPrefix(req.Header.Get("Authorization"), "ApiKey ")
+}
@@ -1,73 +1,132 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 )
 
 const (
-	AccessToken  = "access"
-	RefreshToken = "refresh"
+	AccessToken = "access"
+	// MFAToken proves the password step of a login that still needs a
+	// second factor; it is only accepted by POST /api/login/mfa.
+	MFAToken = "mfa"
+	// PasswordResetToken and VerifyEmailToken are mailed to the user and
+	// carry a jti so the server can accept each of them only once.
+	PasswordResetToken = "password_reset"
+	VerifyEmailToken   = "verify_email"
+
+	// Audience is the aud of every token this server issues for itself.
+	Audience = "chirpy-api"
+)
+
+// Scopes limit what an access token may be used for.
+const (
+	ScopeChirpsRead  = "chirps:read"
+	ScopeChirpsWrite = "chirps:write"
+	ScopeProfile     = "profile"
+	ScopeModerate    = "chirps:moderate"
+	ScopeAdmin       = "admin"
 )
 
-func HashUserPassword(password string) (string, error) {
-	pw, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	return string(pw), err
+// AccessTokenTTL is how long an access token is valid.
+const AccessTokenTTL = time.Hour
+
+var ErrWrongTokenType = errors.New("wrong token type")
+
+// Claims are carried by every token GenerateJWT issues. TokenUse records the
+// token type, so a token minted for one purpose is refused for another.
+type Claims struct {
+	jwt.RegisteredClaims
+	TokenUse  string `json:"token_use"`
+	SessionID int    `json:"sid,omitempty"`
+	Email     string `json:"email,omitempty"`
+	Role      string `json:"role,omitempty"`
+	// Scope is the space separated list of scopes, as in OAuth 2.0.
+	Scope string `json:"scope,omitempty"`
 }
 
-func AuthenticateUser(login string, password string) error {
-	return bcrypt.CompareHashAndPassword([]byte(password), []byte(login))
+func (c Claims) HasScope(scope string) bool {
+	return slices.Contains(strings.Fields(c.Scope), scope)
 }
 
-func GenerateJWT(id int, jwtSecret string, tokenType string) (string, error) {
-	var issuer string
+func GenerateJWT(id int, sessionID int, role string, scopes []string, keys *KeyManager, tokenType string) (string, error) {
+	return generateJWT(keys, tokenType, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject: fmt.Sprintf("%d", id),
+		},
+		SessionID: sessionID,
+		Role:      role,
+		Scope:     strings.Join(scopes, " "),
+	})
+}
+
+// GenerateEmailToken issues a token to be mailed to email, for proving the
+// user behind id can read it. Each token gets a random ID, see Claims.ID.
+func GenerateEmailToken(id int, email string, keys *KeyManager, tokenType string) (string, error) {
+	jti, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	return generateJWT(keys, tokenType, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject: fmt.Sprintf("%d", id),
+			ID:      jti,
+		},
+		Email: email,
+	})
+}
+
+func generateJWT(keys *KeyManager, tokenType string, claims Claims) (string, error) {
 	var expireIn time.Duration
 	switch tokenType {
-	case "access":
-		issuer = "chirpy-access"
+	case AccessToken:
+		expireIn = AccessTokenTTL
+	case MFAToken:
+		expireIn = time.Minute * 5
+	case PasswordResetToken:
 		expireIn = time.Hour * 1
-	case "refresh":
-		issuer = "chirpy-refresh"
-		expireIn = time.Hour * 24 * 60
+	case VerifyEmailToken:
+		expireIn = time.Hour * 24
+	default:
+		return "", fmt.Errorf("unknown token type %q", tokenType)
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    issuer,
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expireIn)),
-		Subject:   fmt.Sprintf("%d", id),
-	})
-	return token.SignedString([]byte(jwtSecret))
+	now := time.Now().UTC()
+	claims.Issuer = "chirpy-" + tokenType
+	claims.Audience = jwt.ClaimStrings{Audience}
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(expireIn))
+	claims.TokenUse = tokenType
+	return keys.sign(claims)
 }
 
-func ValidateJWT(tokenString string, jwtSecret string) (int, string, error) {
-	claimsStruct := jwt.RegisteredClaims{}
-	token, err := jwt.ParseWithClaims(
+// ValidateJWT checks the signature, expiry, issuer and audience of a token
+// and that it was issued as tokenType, and returns its subject and claims.
+func ValidateJWT(tokenString string, keys *KeyManager, tokenType string) (int, Claims, error) {
+	claims := Claims{}
+	_, err := jwt.ParseWithClaims(
 		tokenString,
-		&claimsStruct,
-		func(token *jwt.Token) (interface{}, error) { return []byte(jwtSecret), nil },
+		&claims,
+		keys.keyFunc,
+		jwt.WithValidMethods([]string{AlgEdDSA, AlgRS256}),
+		jwt.WithIssuer("chirpy-"+tokenType),
+		jwt.WithAudience(Audience),
 	)
 	if err != nil {
-		return -1, "", err
-	}
-
-	issuer, err := token.Claims.GetIssuer()
-	if err != nil {
-		return -1, "", err
+		return -1, Claims{}, err
 	}
-
-	id, err := token.Claims.GetSubject()
-	if err != nil {
-		return -1, "", err
+	if claims.TokenUse != tokenType {
+		return -1, Claims{}, ErrWrongTokenType
 	}
 
-	validID, err := strconv.Atoi(id)
+	validID, err := strconv.Atoi(claims.Subject)
 	if err != nil {
-		return -1, "", err
+		return -1, Claims{}, err
 	}
-
-	return validID, issuer, nil
+	return validID, claims, nil
 }
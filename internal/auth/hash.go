@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"sync"
+)
+
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+// HashParams says how new password hashes are made. Stored hashes carry
+// their own algorithm and parameters, in the usual $2a$ form for bcrypt and
+// the PHC string format for Argon2id, so they keep verifying after the
+// parameters change; AuthenticateUser reports them as due for a rehash.
+type HashParams struct {
+	Algorithm     string
+	BcryptCost    int
+	Argon2Time    uint32
+	Argon2Memory  uint32 // in KiB
+	Argon2Threads uint8
+}
+
+// DefaultHashParams keeps bcrypt at its default cost and has the RFC 9106
+// second recommended Argon2id parameters ready for when it is picked.
+func DefaultHashParams() HashParams {
+	return HashParams{
+		Algorithm:     HashBcrypt,
+		BcryptCost:    bcrypt.DefaultCost,
+		Argon2Time:    3,
+		Argon2Memory:  64 * 1024,
+		Argon2Threads: 4,
+	}
+}
+
+func (p HashParams) Validate() error {
+	switch p.Algorithm {
+	case HashBcrypt:
+		if p.BcryptCost < bcrypt.MinCost || p.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case HashArgon2id:
+		if p.Argon2Time < 1 || p.Argon2Threads < 1 || p.Argon2Memory < 8*uint32(p.Argon2Threads) {
+			return errors.New("argon2id needs a time and threads of at least 1 and 8 KiB of memory per thread")
+		}
+	default:
+		return fmt.Errorf("unknown password hash algorithm %q", p.Algorithm)
+	}
+	return nil
+}
+
+// MaxPasswordBytes is the longest password the algorithm fully uses, or
+// zero if there is no such limit.
+func (p HashParams) MaxPasswordBytes() int {
+	if p.Algorithm == HashBcrypt {
+		return bcryptMaxBytes
+	}
+	return 0
+}
+
+func HashUserPassword(password string, params HashParams) (string, error) {
+	switch params.Algorithm {
+	case HashBcrypt:
+		pw, err := bcrypt.GenerateFromPassword([]byte(password), params.BcryptCost)
+		return string(pw), err
+	case HashArgon2id:
+		salt := make([]byte, argon2SaltLength)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, params.Argon2Time, params.Argon2Memory, params.Argon2Threads, argon2KeyLength)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, params.Argon2Memory, params.Argon2Time, params.Argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key),
+		), nil
+	default:
+		return "", fmt.Errorf("unknown password hash algorithm %q", params.Algorithm)
+	}
+}
+
+// AuthenticateUser checks login against the stored hash. On success it also
+// reports whether the hash was made with other algorithm or parameters than
+// params, in which case the caller should store a fresh one.
+func AuthenticateUser(login string, hash string, params HashParams) (bool, error) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		stored, salt, key, err := decodeArgon2id(hash)
+		if err != nil {
+			return false, err
+		}
+		got := argon2.IDKey([]byte(login), salt, stored.Argon2Time, stored.Argon2Memory, stored.Argon2Threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(got, key) != 1 {
+			return false, bcrypt.ErrMismatchedHashAndPassword
+		}
+		outdated := params.Algorithm != HashArgon2id ||
+			stored.Argon2Time != params.Argon2Time ||
+			stored.Argon2Memory != params.Argon2Memory ||
+			stored.Argon2Threads != params.Argon2Threads ||
+			len(salt) != argon2SaltLength ||
+			len(key) != argon2KeyLength
+		return outdated, nil
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return false, ErrUnknownHash
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(login))
+	if err != nil {
+		return false, err
+	}
+	return params.Algorithm != HashBcrypt || cost != params.BcryptCost, nil
+}
+
+func decodeArgon2id(hash string) (HashParams, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return HashParams{}, nil, nil, ErrUnknownHash
+	}
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return HashParams{}, nil, nil, ErrUnknownHash
+	}
+	params := HashParams{Algorithm: HashArgon2id}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Argon2Memory, &params.Argon2Time, &params.Argon2Threads)
+	if err != nil {
+		return HashParams{}, nil, nil, ErrUnknownHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return HashParams{}, nil, nil, ErrUnknownHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return HashParams{}, nil, nil, ErrUnknownHash
+	}
+	return params, salt, key, nil
+}
+
+// dummyHashes stand in for the stored hash when there is no user, so
+// rejecting an unknown email takes as long as rejecting a wrong password.
+var (
+	dummyMux    sync.Mutex
+	dummyHashes = map[HashParams]string{}
+)
+
+// AuthenticateNobody does the work of AuthenticateUser for a login that
+// is bound to fail.
+func AuthenticateNobody(login string, params HashParams) {
+	dummyMux.Lock()
+	hash, ok := dummyHashes[params]
+	if !ok {
+		hash, _ = HashUserPassword("chirpy dummy password", params)
+		dummyHashes[params] = hash
+	}
+	dummyMux.Unlock()
+	AuthenticateUser(login, hash, params)
+}
@@ -0,0 +1,363 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AlgEdDSA = "EdDSA"
+	AlgRS256 = "RS256"
+)
+
+// rsaKeyBits is the size of RSA keys created by GenerateKeyFile.
+const rsaKeyBits = 2048
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// KeyManager holds the keys tokens are signed and verified with. Exactly one
+// key signs; every key it holds verifies, so during a rotation tokens signed
+// with the previous key stay valid until that key is removed. Each token
+// names its key in the kid header.
+type KeyManager struct {
+	mux        sync.RWMutex
+	dir        string
+	keys       map[string]signingKey
+	signingKID string
+}
+
+type signingKey struct {
+	method  jwt.SigningMethod
+	private crypto.PrivateKey
+	public  crypto.PublicKey
+}
+
+func NewKeyManager() *KeyManager {
+	return &KeyManager{keys: map[string]signingKey{}}
+}
+
+// LoadKeyDir returns a KeyManager backed by the PEM files in dir, one key
+// per <kid>.pem, holding either a PKCS #8 private key or, for keys that may
+// only verify, a PKIX public key. The newest private key, by kid, signs. An
+// empty or missing dir gets a fresh Ed25519 key.
+func LoadKeyDir(dir string) (*KeyManager, error) {
+	km := NewKeyManager()
+	km.dir = dir
+	err := km.Reload()
+	if err != nil {
+		return nil, err
+	}
+	if km.signingKID == "" {
+		_, err = GenerateKeyFile(dir, AlgEdDSA)
+		if err != nil {
+			return nil, err
+		}
+		err = km.Reload()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return km, nil
+}
+
+// Reload re-reads the key directory, picking up keys added or removed by a
+// rotation.
+func (km *KeyManager) Reload() error {
+	if km.dir == "" {
+		return nil
+	}
+	paths, err := filepath.Glob(filepath.Join(km.dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+	keys := map[string]signingKey{}
+	signingKID := ""
+	for _, path := range paths {
+		kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+		key, err := readKeyFile(path)
+		if err != nil {
+			return fmt.Errorf("reading key %s: %w", path, err)
+		}
+		keys[kid] = key
+		if key.private != nil && kid > signingKID {
+			signingKID = kid
+		}
+	}
+
+	km.mux.Lock()
+	defer km.mux.Unlock()
+	km.keys = keys
+	km.signingKID = signingKID
+	return nil
+}
+
+// AddKey adds a private key that can sign and verify. Ed25519 keys sign with
+// EdDSA and RSA keys with RS256.
+func (km *KeyManager) AddKey(kid string, private crypto.PrivateKey) error {
+	key, err := newSigningKey(private)
+	if err != nil {
+		return err
+	}
+	km.mux.Lock()
+	defer km.mux.Unlock()
+	km.keys[kid] = key
+	return nil
+}
+
+// AddVerificationKey adds a public key that only verifies.
+func (km *KeyManager) AddVerificationKey(kid string, public crypto.PublicKey) error {
+	key, err := newVerificationKey(public)
+	if err != nil {
+		return err
+	}
+	km.mux.Lock()
+	defer km.mux.Unlock()
+	km.keys[kid] = key
+	return nil
+}
+
+func newSigningKey(private crypto.PrivateKey) (signingKey, error) {
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return signingKey{}, fmt.Errorf("unsupported private key type %T", private)
+	}
+	key, err := newVerificationKey(signer.Public())
+	if err != nil {
+		return signingKey{}, err
+	}
+	key.private = private
+	return key, nil
+}
+
+func newVerificationKey(public crypto.PublicKey) (signingKey, error) {
+	key := signingKey{public: public}
+	switch public.(type) {
+	case ed25519.PublicKey:
+		key.method = jwt.SigningMethodEdDSA
+	case *rsa.PublicKey:
+		key.method = jwt.SigningMethodRS256
+	default:
+		return signingKey{}, fmt.Errorf("unsupported public key type %T", public)
+	}
+	return key, nil
+}
+
+func (km *KeyManager) RemoveKey(kid string) {
+	km.mux.Lock()
+	defer km.mux.Unlock()
+	delete(km.keys, kid)
+	if km.signingKID == kid {
+		km.signingKID = ""
+	}
+}
+
+func (km *KeyManager) SetSigningKey(kid string) error {
+	km.mux.Lock()
+	defer km.mux.Unlock()
+	key, ok := km.keys[kid]
+	if !ok || key.private == nil {
+		return ErrUnknownKey
+	}
+	km.signingKID = kid
+	return nil
+}
+
+func (km *KeyManager) sign(claims jwt.Claims) (string, error) {
+	km.mux.RLock()
+	defer km.mux.RUnlock()
+	key, ok := km.keys[km.signingKID]
+	if !ok || key.private == nil {
+		return "", ErrUnknownKey
+	}
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = km.signingKID
+	return token.SignedString(key.private)
+}
+
+// keyFunc picks the verification key named by the token's kid and refuses a
+// token whose alg does not match that key.
+func (km *KeyManager) keyFunc(token *jwt.Token) (interface{}, error) {
+	km.mux.RLock()
+	defer km.mux.RUnlock()
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := km.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("token alg %s does not match key %s", token.Method.Alg(), kid)
+	}
+	return key.public, nil
+}
+
+// JWK is a public key in RFC 7517 form.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// PublicKey decodes an RSA, Ed25519 or P-256 key.
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch {
+	case k.Kty == "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if len(n) == 0 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA key %s", k.Kid)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		x, err := decode(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key %s", k.Kid)
+		}
+		return ed25519.PublicKey(x), nil
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("invalid P-256 key %s", k.Kid)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s %s", k.Kty, k.Crv)
+	}
+}
+
+// JWKS returns every verification key, for services that check our tokens
+// without holding any secret.
+func (km *KeyManager) JWKS() JWKS {
+	km.mux.RLock()
+	defer km.mux.RUnlock()
+
+	set := JWKS{Keys: []JWK{}}
+	for kid, key := range km.keys {
+		jwk := JWK{Use: "sig", Alg: key.method.Alg(), Kid: kid}
+		switch public := key.public.(type) {
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	sort.Slice(set.Keys, func(i, j int) bool {
+		return set.Keys[i].Kid < set.Keys[j].Kid
+	})
+	return set
+}
+
+// GenerateKeyFile creates a new private key in dir and returns its kid. Kids
+// start with the creation time, so the newest key sorts last and is the one
+// LoadKeyDir signs with.
+func GenerateKeyFile(dir string, alg string) (string, error) {
+	var private crypto.PrivateKey
+	var err error
+	switch alg {
+	case AlgEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	case AlgRS256:
+		private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	default:
+		return "", fmt.Errorf("unsupported key algorithm %q", alg)
+	}
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+	kid := fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102T150405Z"), strings.ToLower(alg))
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	file, err := os.OpenFile(filepath.Join(dir, kid+".pem"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return kid, err
+}
+
+func readKeyFile(path string) (signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return signingKey{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return signingKey{}, errors.New("no PEM block")
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return signingKey{}, err
+		}
+		return newSigningKey(private)
+	case "PUBLIC KEY":
+		public, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return signingKey{}, err
+		}
+		return newVerificationKey(public)
+	default:
+		return signingKey{}, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
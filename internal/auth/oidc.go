@@ -0,0 +1,298 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDCLoginTTL is how long a user has to come back from the provider.
+const OIDCLoginTTL = time.Minute * 10
+
+// jwksRefreshInterval limits how often an unknown kid makes the provider's
+// keys be fetched again, so forged tokens cannot hammer the provider.
+const jwksRefreshInterval = time.Minute
+
+var ErrInvalidIDToken = errors.New("invalid ID token")
+
+// OIDCProvider is an external OpenID Connect provider users can log in with,
+// using the authorization code flow with PKCE.
+type OIDCProvider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+
+	authorizationEndpoint string
+	tokenEndpoint         string
+	jwksURI               string
+	client                *http.Client
+
+	mux         sync.Mutex
+	keys        map[string]any
+	keysFetched time.Time
+}
+
+// OIDCIdentity is what a verified ID token says about the user.
+type OIDCIdentity struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+// DiscoverOIDCProvider reads the provider's configuration from its discovery
+// document. The issuer must be https, except on a loopback address so a
+// local stand-in provider can be used for development.
+func DiscoverOIDCProvider(ctx context.Context, issuer string, clientID string, clientSecret string, redirectURL string) (*OIDCProvider, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+	if !secureURL(issuer) {
+		return nil, fmt.Errorf("OIDC issuer %q must be https", issuer)
+	}
+	provider := &OIDCProvider{
+		Issuer:       issuer,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		client:       &http.Client{Timeout: time.Second * 10},
+	}
+
+	discovery := struct {
+		Issuer                string   `json:"issuer"`
+		AuthorizationEndpoint string   `json:"authorization_endpoint"`
+		TokenEndpoint         string   `json:"token_endpoint"`
+		JWKSURI               string   `json:"jwks_uri"`
+		CodeChallengeMethods  []string `json:"code_challenge_methods_supported"`
+	}{}
+	err := provider.getJSON(ctx, issuer+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != issuer {
+		return nil, fmt.Errorf("OIDC discovery names issuer %q, expected %q", discovery.Issuer, issuer)
+	}
+	for _, v := range []string{discovery.AuthorizationEndpoint, discovery.TokenEndpoint, discovery.JWKSURI} {
+		if !secureURL(v) {
+			return nil, fmt.Errorf("OIDC endpoint %q must be https", v)
+		}
+	}
+	if len(discovery.CodeChallengeMethods) > 0 && !slices.Contains(discovery.CodeChallengeMethods, PKCEMethodS256) {
+		return nil, errors.New("OIDC provider does not support S256 PKCE")
+	}
+	provider.authorizationEndpoint = discovery.AuthorizationEndpoint
+	provider.tokenEndpoint = discovery.TokenEndpoint
+	provider.jwksURI = discovery.JWKSURI
+	return provider, nil
+}
+
+func secureURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if u.Scheme == "https" {
+		return true
+	}
+	ip := net.ParseIP(u.Hostname())
+	return u.Scheme == "http" && (u.Hostname() == "localhost" || ip != nil && ip.IsLoopback())
+}
+
+// NewOIDCLogin returns the state, nonce and PKCE code verifier for one login
+// attempt. All three are random and must be kept until the callback.
+func NewOIDCLogin() (state string, nonce string, verifier string, err error) {
+	for _, v := range []*string{&state, &nonce, &verifier} {
+		*v, err = randomToken()
+		if err != nil {
+			return "", "", "", err
+		}
+	}
+	return state, nonce, verifier, nil
+}
+
+// AuthCodeURL is where the user is sent to log in at the provider.
+func (p *OIDCProvider) AuthCodeURL(state string, nonce string, verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {"openid email"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {PKCEMethodS256},
+	}
+	separator := "?"
+	if strings.Contains(p.authorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return p.authorizationEndpoint + separator + query.Encode()
+}
+
+// Exchange redeems the code the provider sent back and verifies the ID token
+// it answers with.
+func (p *OIDCProvider) Exchange(ctx context.Context, code string, verifier string, nonce string) (OIDCIdentity, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if p.ClientSecret == "" {
+		form.Set("client_id", p.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return OIDCIdentity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	token := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	err = p.doJSON(req, &token)
+	if err != nil {
+		return OIDCIdentity{}, err
+	}
+	if token.IDToken == "" {
+		return OIDCIdentity{}, errors.New("OIDC token response has no id_token")
+	}
+	return p.VerifyIDToken(ctx, token.IDToken, nonce)
+}
+
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	AuthorizedParty string `json:"azp,omitempty"`
+	Nonce           string `json:"nonce"`
+	Email           string `json:"email"`
+	// EmailVerified is a string at some providers.
+	EmailVerified any `json:"email_verified"`
+}
+
+// VerifyIDToken checks an ID token as OpenID Connect Core 3.1.3.7 asks: the
+// signature against the provider's keys, the issuer, the audience, the
+// expiry and the nonce of the login it answers.
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, raw string, nonce string) (OIDCIdentity, error) {
+	claims := idTokenClaims{}
+	_, err := jwt.ParseWithClaims(
+		raw,
+		&claims,
+		func(token *jwt.Token) (any, error) {
+			kid, _ := token.Header["kid"].(string)
+			return p.key(ctx, kid)
+		},
+		jwt.WithValidMethods([]string{AlgRS256, "RS384", "RS512", "ES256", AlgEdDSA}),
+		jwt.WithIssuer(p.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return OIDCIdentity{}, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	switch {
+	case claims.ExpiresAt == nil:
+		return OIDCIdentity{}, fmt.Errorf("%w: no expiry", ErrInvalidIDToken)
+	case claims.Subject == "":
+		return OIDCIdentity{}, fmt.Errorf("%w: no subject", ErrInvalidIDToken)
+	case (len(claims.Audience) > 1 || claims.AuthorizedParty != "") && claims.AuthorizedParty != p.ClientID:
+		return OIDCIdentity{}, fmt.Errorf("%w: issued to %q", ErrInvalidIDToken, claims.AuthorizedParty)
+	case nonce == "" || claims.Nonce != nonce:
+		return OIDCIdentity{}, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+	verified, _ := claims.EmailVerified.(bool)
+	if s, ok := claims.EmailVerified.(string); ok {
+		verified = s == "true"
+	}
+	return OIDCIdentity{
+		Issuer:        p.Issuer,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: verified,
+	}, nil
+}
+
+// key returns the provider's signing key kid, fetching the key set again
+// when the kid is unknown, which is how providers announce a rotation.
+func (p *OIDCProvider) key(ctx context.Context, kid string) (any, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	key, ok := p.lookupKey(kid)
+	if ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < jwksRefreshInterval {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	jwks := JWKS{}
+	err := p.getJSON(ctx, p.jwksURI, &jwks)
+	if err != nil {
+		return nil, err
+	}
+	p.keysFetched = time.Now()
+	p.keys = map[string]any{}
+	for _, v := range jwks.Keys {
+		if v.Use != "" && v.Use != "sig" {
+			continue
+		}
+		key, err := v.PublicKey()
+		if err != nil {
+			continue
+		}
+		p.keys[v.Kid] = key
+	}
+	key, ok = p.lookupKey(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+func (p *OIDCProvider) lookupKey(kid string) (any, bool) {
+	key, ok := p.keys[kid]
+	if !ok && kid == "" && len(p.keys) == 1 {
+		// A provider with a single key may leave kid out.
+		for _, v := range p.keys {
+			return v, true
+		}
+	}
+	return key, ok
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	return p.doJSON(req, v)
+}
+
+func (p *OIDCProvider) doJSON(req *http.Request, v any) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", req.Method, req.URL.Redacted(), resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
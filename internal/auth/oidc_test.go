@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubProvider is a stand-in OpenID Connect provider: it logs everyone in
+// straight away and signs ID tokens with an Ed25519 key.
+type stubProvider struct {
+	*httptest.Server
+	key ed25519.PrivateKey
+
+	mux   sync.Mutex
+	codes map[string]url.Values
+}
+
+func newStubProvider(t *testing.T) *stubProvider {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &stubProvider{key: private, codes: map[string]url.Values{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                           p.URL,
+			"authorization_endpoint":           p.URL + "/authorize",
+			"token_endpoint":                   p.URL + "/token",
+			"jwks_uri":                         p.URL + "/jwks",
+			"code_challenge_methods_supported": []string{PKCEMethodS256},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(JWKS{Keys: []JWK{{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(public),
+			Kid: "k1",
+			Use: "sig",
+			Alg: AlgEdDSA,
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		code := query.Get("state") + "-code"
+		p.mux.Lock()
+		p.codes[code] = query
+		p.mux.Unlock()
+		http.Redirect(w, req, query.Get("redirect_uri")+"?code="+code+"&state="+query.Get("state"), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		p.mux.Lock()
+		query, ok := p.codes[req.PostForm.Get("code")]
+		delete(p.codes, req.PostForm.Get("code"))
+		p.mux.Unlock()
+		clientID, secret, _ := req.BasicAuth()
+		sum := sha256.Sum256([]byte(req.PostForm.Get("code_verifier")))
+		if !ok || clientID != "rp" || secret != "rp-secret" || base64.RawURLEncoding.EncodeToString(sum[:]) != query.Get("code_challenge") {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"id_token": p.sign(t, p.claims(query.Get("nonce")), "k1"),
+		})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// claims are those of a valid ID token for the login with nonce.
+func (p *stubProvider) claims(nonce string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":            p.URL,
+		"sub":            "alice",
+		"aud":            "rp",
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Minute).Unix(),
+		"nonce":          nonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+	}
+}
+
+func (p *stubProvider) sign(t *testing.T, claims jwt.MapClaims, kid string) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = kid
+	raw, err := token.SignedString(p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func (p *stubProvider) discover(t *testing.T) *OIDCProvider {
+	t.Helper()
+	provider, err := DiscoverOIDCProvider(context.Background(), p.URL, "rp", "rp-secret", "http://127.0.0.1/api/oidc/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+// authorize follows the authorization URL and returns the code the provider
+// sends back.
+func authorize(t *testing.T, authURL string) string {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location.Query().Get("code")
+}
+
+func TestOIDCLogin(t *testing.T) {
+	stub := newStubProvider(t)
+	provider := stub.discover(t)
+	state, nonce, verifier, err := NewOIDCLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := authorize(t, provider.AuthCodeURL(state, nonce, verifier))
+
+	_, err = provider.Exchange(context.Background(), code, "wrong verifier", nonce)
+	if err == nil {
+		t.Error("Exchange with the wrong PKCE verifier succeeded")
+	}
+
+	code = authorize(t, provider.AuthCodeURL(state, nonce, verifier))
+	identity, err := provider.Exchange(context.Background(), code, verifier, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := OIDCIdentity{Issuer: stub.URL, Subject: "alice", Email: "alice@example.com", EmailVerified: true}
+	if identity != want {
+		t.Errorf("Exchange = %+v, want %+v", identity, want)
+	}
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	stub := newStubProvider(t)
+	issuer := strings.Replace(stub.URL, "127.0.0.1", "localhost", 1)
+	_, err := DiscoverOIDCProvider(context.Background(), issuer, "rp", "rp-secret", "")
+	if err == nil {
+		t.Error("discovery accepted a document naming another issuer")
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	stub := newStubProvider(t)
+	provider := stub.discover(t)
+	const nonce = "nonce"
+
+	tests := []struct {
+		name   string
+		modify func(claims jwt.MapClaims)
+		kid    string
+	}{
+		{"wrong audience", func(c jwt.MapClaims) { c["aud"] = "other" }, "k1"},
+		{"wrong issuer", func(c jwt.MapClaims) { c["iss"] = "https://evil.example" }, "k1"},
+		{"wrong nonce", func(c jwt.MapClaims) { c["nonce"] = "other" }, "k1"},
+		{"expired", func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, "k1"},
+		{"no expiry", func(c jwt.MapClaims) { delete(c, "exp") }, "k1"},
+		{"issued in the future", func(c jwt.MapClaims) { c["iat"] = time.Now().Add(time.Hour).Unix() }, "k1"},
+		{"no subject", func(c jwt.MapClaims) { delete(c, "sub") }, "k1"},
+		{"issued to another party", func(c jwt.MapClaims) { c["aud"] = []string{"rp", "other"}; c["azp"] = "other" }, "k1"},
+		{"unknown key", func(c jwt.MapClaims) {}, "k2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := stub.claims(nonce)
+			tt.modify(claims)
+			_, err := provider.VerifyIDToken(context.Background(), stub.sign(t, claims, tt.kid), nonce)
+			if !errors.Is(err, ErrInvalidIDToken) {
+				t.Errorf("err = %v, want ErrInvalidIDToken", err)
+			}
+		})
+	}
+
+	raw := stub.sign(t, stub.claims(nonce), "k1")
+	_, err := provider.VerifyIDToken(context.Background(), raw[:len(raw)-4]+"AAAA", nonce)
+	if !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("bad signature: err = %v, want ErrInvalidIDToken", err)
+	}
+	_, err = provider.VerifyIDToken(context.Background(), raw, "")
+	if !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("no nonce expected: err = %v, want ErrInvalidIDToken", err)
+	}
+	_, err = provider.VerifyIDToken(context.Background(), raw, nonce)
+	if err != nil {
+		t.Errorf("valid token: %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// bcryptMaxBytes is the most of a password bcrypt looks at. Anything past it
+// would be ignored, so a policy for bcrypt refuses longer passwords.
+const bcryptMaxBytes = 72
+
+// defaultBannedPasswords are refused even without a banned list file.
+var defaultBannedPasswords = []string{
+	"password", "password1", "password123", "passw0rd", "12345678",
+	"123456789", "1234567890", "qwertyuiop", "iloveyou", "sunshine",
+	"letmein1", "welcome1", "football", "baseball", "chirpy123",
+}
+
+// PasswordPolicy decides which passwords users may choose.
+type PasswordPolicy struct {
+	MinLength int // in characters
+	MaxBytes  int
+	banned    map[string]bool
+	breached  *BreachedList
+}
+
+// PolicyViolation is one rule a password broke.
+type PolicyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PolicyError lists every rule a password broke.
+type PolicyError struct {
+	Violations []PolicyViolation
+}
+
+func (e *PolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = v.Message
+	}
+	return "password rejected: " + strings.Join(messages, "; ")
+}
+
+func NewPasswordPolicy(minLength int, maxBytes int) *PasswordPolicy {
+	policy := &PasswordPolicy{
+		MinLength: minLength,
+		MaxBytes:  maxBytes,
+		banned:    map[string]bool{},
+	}
+	policy.Ban(defaultBannedPasswords...)
+	return policy
+}
+
+// Ban refuses the given passwords, ignoring case.
+func (p *PasswordPolicy) Ban(passwords ...string) {
+	for _, v := range passwords {
+		p.banned[strings.ToLower(v)] = true
+	}
+}
+
+// LoadBannedFile bans every non-empty line of the file at path.
+func (p *PasswordPolicy) LoadBannedFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			p.Ban(line)
+		}
+	}
+	return scanner.Err()
+}
+
+// CheckBreached also refuses passwords found in list.
+func (p *PasswordPolicy) CheckBreached(list *BreachedList) {
+	p.breached = list
+}
+
+// Check returns a *PolicyError naming every rule password breaks, if any.
+// email is the account's address, which makes a poor password too.
+func (p *PasswordPolicy) Check(password string, email string) error {
+	violations := []PolicyViolation{}
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, PolicyViolation{
+			Rule:    "min_length",
+			Message: fmt.Sprintf("must be at least %d characters long", p.MinLength),
+		})
+	}
+	if len(password) > p.MaxBytes {
+		violations = append(violations, PolicyViolation{
+			Rule:    "max_bytes",
+			Message: fmt.Sprintf("must be at most %d bytes long", p.MaxBytes),
+		})
+	}
+	lower := strings.ToLower(password)
+	if p.banned[lower] {
+		violations = append(violations, PolicyViolation{
+			Rule:    "banned",
+			Message: "is too common",
+		})
+	}
+	localPart, _, _ := strings.Cut(strings.ToLower(email), "@")
+	if email != "" && (lower == strings.ToLower(email) || lower == localPart) {
+		violations = append(violations, PolicyViolation{
+			Rule:    "matches_email",
+			Message: "must not be your email address",
+		})
+	}
+	if p.breached != nil {
+		found, err := p.breached.Contains(password)
+		if err != nil {
+			return err
+		}
+		if found {
+			violations = append(violations, PolicyViolation{
+				Rule:    "breached",
+				Message: "has appeared in a data breach",
+			})
+		}
+	}
+	if len(violations) > 0 {
+		return &PolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// BreachedList looks passwords up in a local copy of a breached password
+// corpus in the k-anonymity range format: the directory holds one file per
+// 5 character prefix of the upper case SHA-1 hex digest, named after the
+// prefix with an optional .txt extension, whose lines are the remaining 35
+// characters and a count separated by a colon.
+type BreachedList struct {
+	dir string
+}
+
+func NewBreachedList(dir string) (*BreachedList, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &BreachedList{dir: dir}, nil
+}
+
+// Contains reports whether password appears in the list. Only the file for
+// its hash prefix is read; a missing file means no password with that prefix
+// was breached.
+func (b *BreachedList) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	digest := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := digest[:5], digest[5:]
+
+	file, err := os.Open(filepath.Join(b.dir, prefix))
+	if errors.Is(err, os.ErrNotExist) {
+		file, err = os.Open(filepath.Join(b.dir, prefix+".txt"))
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		hash, count, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !strings.EqualFold(hash, suffix) {
+			continue
+		}
+		// Padding entries in range files carry a count of zero.
+		n, err := strconv.Atoi(count)
+		return err != nil || n > 0, nil
+	}
+	return false, scanner.Err()
+}
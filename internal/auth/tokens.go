@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+// RefreshTokenTTL is how long an unused refresh token stays valid.
+const RefreshTokenTTL = time.Hour * 24 * 60
+
+// NewRefreshToken returns a random opaque token for the client and the hash
+// to store in its place.
+func NewRefreshToken() (string, string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	return token, HashToken(token), nil
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// HashToken is how opaque tokens are looked up without being stored.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeyPrefix starts every personal API key, so leaked keys are easy to
+// spot, e.g. by secret scanners.
+const APIKeyPrefix = "chirpy_"
+
+// DefaultAPIKeyTTL and MaxAPIKeyTTL bound how long a personal API key lives.
+const (
+	DefaultAPIKeyTTL = time.Hour * 24 * 30
+	MaxAPIKeyTTL     = time.Hour * 24 * 365
+)
+
+// NewAPIKey returns a random personal API key and the hash to store in its
+// place.
+func NewAPIKey() (string, string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	key := APIKeyPrefix + token
+	return key, HashToken(key), nil
+}
@@ -0,0 +1,102 @@
+package database
+
+import "time"
+
+// APIKey is a personal API key, stored under its hash. It acts for its user
+// within its scopes until it expires or is revoked.
+type APIKey struct {
+	ID   int    `json:"id"`
+	Hash string `json:"hash"`
+	// Prefix is the start of the key, shown so the user can tell keys
+	// apart.
+	Prefix     string     `json:"prefix"`
+	Name       string     `json:"name"`
+	UserID     int        `json:"user_id"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+func (db *DB) CreateAPIKey(key APIKey) (APIKey, error) {
+	err := db.Update(func(tx *Tx) error {
+		if _, ok := tx.Users[key.UserID]; !ok {
+			return ErrNotExist
+		}
+		if _, ok := tx.APIKeys[key.Hash]; ok {
+			return ErrAlreadyExists
+		}
+		key.ID = tx.nextID(tableAPIKeys)
+		key.CreatedAt = time.Now().UTC()
+		tx.putAPIKey(key)
+		return nil
+	})
+	if err != nil {
+		return APIKey{}, err
+	}
+	return key, nil
+}
+
+func (db *DB) GetAPIKeyByHash(hash string) (APIKey, error) {
+	key := APIKey{}
+	err := db.View(func(tx *Tx) error {
+		v, ok := tx.APIKeys[hash]
+		if !ok {
+			return ErrNotExist
+		}
+		key = v
+		return nil
+	})
+	if err != nil {
+		return APIKey{}, err
+	}
+	return key, nil
+}
+
+func (db *DB) ListAPIKeys(userID int) ([]APIKey, error) {
+	keys := []APIKey{}
+	err := db.View(func(tx *Tx) error {
+		for _, v := range tx.APIKeys {
+			if v.UserID == userID {
+				keys = append(keys, v)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return []APIKey{}, err
+	}
+	return keys, nil
+}
+
+// DeleteAPIKey revokes one of the user's keys. Keys of other users are
+// reported as not existing.
+func (db *DB) DeleteAPIKey(id int, userID int) error {
+	return db.Update(func(tx *Tx) error {
+		for hash, v := range tx.APIKeys {
+			if v.ID == id && v.UserID == userID {
+				tx.deleteAPIKey(hash)
+				return nil
+			}
+		}
+		return ErrNotExist
+	})
+}
+
+// PurgeExpiredAPIKeys drops keys that expired before the given time.
+func (db *DB) PurgeExpiredAPIKeys(before time.Time) (int, error) {
+	purged := 0
+	err := db.Update(func(tx *Tx) error {
+		for hash, v := range tx.APIKeys {
+			if v.ExpiresAt.Before(before) {
+				tx.deleteAPIKey(hash)
+				purged++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
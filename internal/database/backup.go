@@ -0,0 +1,187 @@
+package database
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Snapshot writes the whole database as a JSON document in the same layout
+// as the database file. The document is taken under the read lock, so it is
+// consistent, and written after the lock is released, so a slow w does not
+// hold up writers.
+func (db *DB) Snapshot(w io.Writer) error {
+	var dat []byte
+	err := db.View(func(tx *Tx) error {
+		var err error
+		dat, err = json.MarshalIndent(tx.DBStructure, "", "\t")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(dat)
+	return err
+}
+
+// ErrInvalidBackup is returned by Restore for a document it cannot read.
+var ErrInvalidBackup = errors.New("invalid backup")
+
+// Restore replaces the whole database with a document written by Snapshot
+// and migrates it if it comes from an older schema version. It holds the
+// write lock while the data is swapped, so it is safe on a live database.
+func (db *DB) Restore(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	dbStructure, err := decodeDB(data)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	err = checkSchemaVersion(dbStructure.SchemaVersion)
+	if err != nil {
+		return err
+	}
+
+	db.mux.Lock()
+	err = db.engine.write(&dbStructure, nil)
+	if err == nil {
+		db.setData(&dbStructure)
+	}
+	db.mux.Unlock()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Migrate(false)
+	return err
+}
+
+// Tables lists the names of the exportable tables.
+func Tables() []string {
+	tables := []string{}
+	t := reflect.TypeOf(DBStructure{})
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Type.Kind() != reflect.Map || t.Field(i).Type.Elem().Kind() != reflect.Struct {
+			continue
+		}
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		tables = append(tables, name)
+	}
+	return tables
+}
+
+// ExportJSONL writes one {"table": ..., "row": ...} line per row of the
+// given tables, in ID order.
+func (db *DB) ExportJSONL(w io.Writer, tables ...string) error {
+	return db.View(func(tx *Tx) error {
+		encoder := json.NewEncoder(w)
+		for _, table := range tables {
+			rows, err := sortedRows(tx.DBStructure, table)
+			if err != nil {
+				return err
+			}
+			for _, row := range rows {
+				err = encoder.Encode(struct {
+					Table string      `json:"table"`
+					Row   interface{} `json:"row"`
+				}{table, row.Interface()})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// ExportCSV writes one table as CSV with a header row of its JSON field
+// names. Nested values are written as JSON.
+func (db *DB) ExportCSV(w io.Writer, table string) error {
+	return db.View(func(tx *Tx) error {
+		rows, err := sortedRows(tx.DBStructure, table)
+		if err != nil {
+			return err
+		}
+		field, _ := tableField(tx.DBStructure, table)
+		columns, indexes := csvColumns(field.Type().Elem())
+
+		writer := csv.NewWriter(w)
+		err = writer.Write(columns)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			record := make([]string, len(indexes))
+			for i, index := range indexes {
+				record[i], err = csvValue(row.Field(index))
+				if err != nil {
+					return err
+				}
+			}
+			err = writer.Write(record)
+			if err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	})
+}
+
+func sortedRows(dbStructure *DBStructure, table string) ([]reflect.Value, error) {
+	field, err := tableField(dbStructure, table)
+	if err != nil {
+		return nil, err
+	}
+	if field.Kind() != reflect.Map || field.Type().Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%q is not an exportable table", table)
+	}
+	keys := field.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].CanInt() {
+			return keys[i].Int() < keys[j].Int()
+		}
+		return keys[i].String() < keys[j].String()
+	})
+	rows := make([]reflect.Value, len(keys))
+	for i, key := range keys {
+		rows[i] = field.MapIndex(key)
+	}
+	return rows, nil
+}
+
+func csvColumns(t reflect.Type) ([]string, []int) {
+	columns := []string{}
+	indexes := []int{}
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		columns = append(columns, name)
+		indexes = append(indexes, i)
+	}
+	return columns, indexes
+}
+
+func csvValue(v reflect.Value) (string, error) {
+	if v.Kind() == reflect.Pointer && v.IsNil() {
+		return "", nil
+	}
+	dat, err := json.Marshal(v.Interface())
+	if err != nil {
+		return "", err
+	}
+	text := ""
+	if json.Unmarshal(dat, &text) == nil {
+		return text, nil
+	}
+	return string(dat), nil
+}
@@ -1,70 +1,195 @@
 package database
 
+import "time"
+
 type Chirp struct {
-	ID       int    `json:"id"`
-	Body     string `json:"body"`
-	AuthorID int    `json:"author_id"`
+	ID        int        `json:"id"`
+	Body      string     `json:"body"`
+	AuthorID  int        `json:"author_id"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	DeletedBy int        `json:"deleted_by,omitempty"`
 }
 
 func (db *DB) CreateChirp(post string, authorID int) (Chirp, error) {
-	dbStruct, err := db.loadDB()
+	chirp := Chirp{}
+	err := db.Update(func(tx *Tx) error {
+		id := tx.nextID(tableChirps)
+		chirp = Chirp{
+			ID:       id,
+			Body:     post,
+			AuthorID: authorID,
+		}
+		tx.putChirp(chirp)
+		return nil
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
+	return chirp, nil
+}
 
-	id := len(dbStruct.Chirps) + 1
-	chirp := Chirp{
-		ID:       id,
-		Body:     post,
-		AuthorID: authorID,
+func (db *DB) GetChirps() ([]Chirp, error) {
+	data := []Chirp{}
+	err := db.View(func(tx *Tx) error {
+		data = make([]Chirp, 0, len(tx.Chirps))
+		for _, v := range tx.Chirps {
+			if v.DeletedAt != nil {
+				continue
+			}
+			data = append(data, v)
+		}
+		return nil
+	})
+	if err != nil {
+		return []Chirp{}, err
 	}
-	dbStruct.Chirps[id] = chirp
+	return data, nil
+}
 
-	err = db.writeDB(dbStruct)
+func (db *DB) GetChirpsByAuthor(authorID int) ([]Chirp, error) {
+	data := []Chirp{}
+	err := db.View(func(tx *Tx) error {
+		for _, v := range tx.chirpsByAuthor(authorID) {
+			if v.DeletedAt != nil {
+				continue
+			}
+			data = append(data, v)
+		}
+		return nil
+	})
+	if err != nil {
+		return []Chirp{}, err
+	}
+	return data, nil
+}
+
+func (db *DB) GetChirpByID(ID int) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.View(func(tx *Tx) error {
+		v, ok := tx.Chirps[ID]
+		if !ok || v.DeletedAt != nil {
+			return ErrNotExist
+		}
+		chirp = v
+		return nil
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
 	return chirp, nil
 }
 
-func (db *DB) GetChirps() ([]Chirp, error) {
-	dbBuf, err := db.loadDB()
+// DeleteChirp soft-deletes the chirp, recording when and by whom. It stays
+// restorable until PurgeDeletedChirps removes it.
+func (db *DB) DeleteChirp(ID int, authorID int) (Chirp, error) {
+	deletedChirp := Chirp{}
+	err := db.Update(func(tx *Tx) error {
+		v, ok := tx.Chirps[ID]
+		if !ok || v.DeletedAt != nil || v.AuthorID != authorID {
+			return ErrNotExist
+		}
+		now := time.Now().UTC()
+		v.DeletedAt = &now
+		v.DeletedBy = authorID
+		tx.putChirp(v)
+		deletedChirp = v
+		return nil
+	})
 	if err != nil {
-		return []Chirp{}, err
+		return Chirp{}, err
 	}
-	data := make([]Chirp, 0, len(dbBuf.Chirps))
+	return deletedChirp, nil
+}
 
-	//_ := json.Unmarshal(dbBuf.Chirps, &data)
-	for _, v := range dbBuf.Chirps {
-		data = append(data, v)
+// ModerateChirp deletes a chirp on behalf of a moderator, whoever wrote it.
+func (db *DB) ModerateChirp(ID int, moderatorID int) (Chirp, error) {
+	deletedChirp := Chirp{}
+	err := db.Update(func(tx *Tx) error {
+		v, ok := tx.Chirps[ID]
+		if !ok || v.DeletedAt != nil {
+			return ErrNotExist
+		}
+		now := time.Now().UTC()
+		v.DeletedAt = &now
+		v.DeletedBy = moderatorID
+		tx.putChirp(v)
+		deletedChirp = v
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
 	}
-	return data, nil
+	return deletedChirp, nil
 }
 
-func (db *DB) GetChirpByID(ID int) (Chirp, error) {
-	dbBuf, err := db.loadDB()
+func (db *DB) GetDeletedChirp(ID int) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.View(func(tx *Tx) error {
+		v, ok := tx.Chirps[ID]
+		if !ok || v.DeletedAt == nil {
+			return ErrNotExist
+		}
+		chirp = v
+		return nil
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
-	for _, v := range dbBuf.Chirps {
-		if v.ID == ID {
-			return v, nil
+	return chirp, nil
+}
+
+// GetDeletedChirpsByAuthor lists the author's chirps that are deleted but
+// not yet purged.
+func (db *DB) GetDeletedChirpsByAuthor(authorID int) ([]Chirp, error) {
+	data := []Chirp{}
+	err := db.View(func(tx *Tx) error {
+		for _, v := range tx.chirpsByAuthor(authorID) {
+			if v.DeletedAt != nil {
+				data = append(data, v)
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return []Chirp{}, err
 	}
-	return Chirp{}, ErrNotExist
+	return data, nil
 }
 
-func (db *DB) DeleteChirp(ID int, authorID int) (Chirp, error) {
-	dbBuf, err := db.loadDB()
+func (db *DB) RestoreChirp(ID int) (Chirp, error) {
+	restoredChirp := Chirp{}
+	err := db.Update(func(tx *Tx) error {
+		v, ok := tx.Chirps[ID]
+		if !ok || v.DeletedAt == nil {
+			return ErrNotExist
+		}
+		v.DeletedAt = nil
+		v.DeletedBy = 0
+		tx.putChirp(v)
+		restoredChirp = v
+		return nil
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
-	for i, v := range dbBuf.Chirps {
-		if v.ID == ID && v.AuthorID == authorID {
-			deletedChirp := dbBuf.Chirps[i]
-			dbBuf.Chirps[i] = Chirp{}
-			return deletedChirp, nil
+	return restoredChirp, nil
+}
+
+// PurgeDeletedChirps hard-deletes every chirp soft-deleted before the given
+// time and reports how many were removed.
+func (db *DB) PurgeDeletedChirps(before time.Time) (int, error) {
+	purged := 0
+	err := db.Update(func(tx *Tx) error {
+		for id, v := range tx.Chirps {
+			if v.DeletedAt != nil && v.DeletedAt.Before(before) {
+				tx.deleteChirp(id)
+				purged++
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
-	return Chirp{}, ErrNotExist
+	return purged, nil
 }
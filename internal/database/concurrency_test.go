@@ -0,0 +1,80 @@
+package database
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// Concurrent writers must each get their own ID and none of their writes may
+// be lost, neither in memory nor on disk. Run with -race.
+func TestConcurrentWrites(t *testing.T) {
+	const writers, perWriter = 8, 25
+	forEachEngine(t, func(t *testing.T, db *DB, reopen func() *DB) {
+		chirpIDs := make(chan int, writers*perWriter)
+		userIDs := make(chan int, writers*perWriter)
+		wg := sync.WaitGroup{}
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < perWriter; i++ {
+					chirp, err := db.CreateChirp(fmt.Sprintf("chirp %d-%d", w, i), w+1)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					chirpIDs <- chirp.ID
+					user, err := db.CreateUser(fmt.Sprintf("user%d-%d@example.com", w, i), "hash")
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					userIDs <- user.ID
+					// Readers run alongside the writers.
+					_, err = db.GetChirpsByAuthor(w + 1)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(chirpIDs)
+		close(userIDs)
+
+		checkUnique := func(what string, ids chan int) {
+			seen := map[int]bool{}
+			for id := range ids {
+				if seen[id] {
+					t.Errorf("%s ID %d handed out twice", what, id)
+				}
+				seen[id] = true
+			}
+			if len(seen) != writers*perWriter {
+				t.Errorf("got %d %s IDs, want %d", len(seen), what, writers*perWriter)
+			}
+		}
+		checkUnique("chirp", chirpIDs)
+		checkUnique("user", userIDs)
+
+		db = reopen()
+		chirps, err := db.GetChirps()
+		if err != nil || len(chirps) != writers*perWriter {
+			t.Errorf("GetChirps after reopen = %d chirps, %v; want %d", len(chirps), err, writers*perWriter)
+		}
+		for w := 0; w < writers; w++ {
+			chirps, err := db.GetChirpsByAuthor(w + 1)
+			if err != nil || len(chirps) != perWriter {
+				t.Errorf("GetChirpsByAuthor(%d) = %d chirps, %v; want %d", w+1, len(chirps), err, perWriter)
+			}
+			for i := 0; i < perWriter; i++ {
+				_, err := db.GetUserByEmail(fmt.Sprintf("user%d-%d@example.com", w, i))
+				if err != nil {
+					t.Errorf("user %d-%d lost: %v", w, i, err)
+				}
+			}
+		}
+	})
+}
@@ -3,78 +3,365 @@ package database
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
+	"reflect"
+	"strings"
 	"sync"
 )
 
+// DB keeps the decoded database in memory as the source of truth. Reads are
+// served from it under the read lock; the engine is only consulted on open,
+// on commit, and when the stored copy was changed behind the DB's back.
 type DB struct {
-	path string
-	mux  *sync.RWMutex
+	engine engine
+	mux    *sync.RWMutex
+	data   *DBStructure
+	idx    *index
 }
 
-var ErrNotExist = errors.New("resource does not exist")
+var (
+	ErrNotExist = errors.New("resource does not exist")
+	// ErrLocked is returned when another process has the database open.
+	ErrLocked = errors.New("database is in use by another process")
+	// ErrReadOnly is returned by writes to a DB opened with NewReadOnlyDB
+	// or NewReadOnlyWALDB.
+	ErrReadOnly = errors.New("database is opened read-only")
+)
 
 type DBStructure struct {
-	Chirps map[int]Chirp `json:"chirps"`
-	Users  map[int]User  `json:"users"`
+	SchemaVersion int `json:"schema_version"`
+
+	Chirps        map[int]Chirp           `json:"chirps"`
+	Users         map[int]User            `json:"users"`
+	Sessions      map[int]Session         `json:"sessions"`
+	RefreshTokens map[string]RefreshToken `json:"refresh_tokens"`
+	// UsedTokens remembers the IDs of spent single-use tokens until they
+	// expire.
+	UsedTokens map[string]UsedToken `json:"used_tokens"`
+	// OAuthClients are keyed by client ID, AuthCodes by the hash of the
+	// code.
+	OAuthClients map[string]OAuthClient `json:"oauth_clients"`
+	AuthCodes    map[string]AuthCode    `json:"auth_codes"`
+	// Identities are keyed by issuer and subject, see Identity.
+	Identities map[string]Identity `json:"identities"`
+	// APIKeys are keyed by the hash of the key.
+	APIKeys map[string]APIKey `json:"api_keys"`
+	// Sequences holds the last ID handed out per table. IDs are never
+	// reused, even after the row they named is deleted.
+	Sequences map[string]int `json:"sequences"`
+}
+
+const (
+	tableChirps        = "chirps"
+	tableUsers         = "users"
+	tableSessions      = "sessions"
+	tableRefreshTokens = "refresh_tokens"
+	tableUsedTokens    = "used_tokens"
+	tableOAuthClients  = "oauth_clients"
+	tableAuthCodes     = "auth_codes"
+	tableIdentities    = "identities"
+	tableAPIKeys       = "api_keys"
+	tableSequences     = "sequences"
+	fieldSchemaVersion = "schema_version"
+)
+
+// engine persists the database. write receives the full state together with
+// the rows the transaction touched, so an engine can store either. A nil
+// changes means the whole state was replaced.
+type engine interface {
+	load() (DBStructure, error)
+	write(dbStructure *DBStructure, changes []change) error
+	// stale reports whether the stored copy changed since the last load or
+	// write, i.e. someone else modified it.
+	stale() bool
+	close() error
+}
+
+// defaultBackups is how many previous generations of the database file are
+// kept next to it unless WithBackups says otherwise.
+const defaultBackups = 3
+
+type options struct {
+	backups        int
+	skipMigrations bool
+}
+
+type Option func(*options)
+
+// WithBackups sets how many previous generations of the database file are
+// kept as <path>.1 (newest) to <path>.n. Zero disables backups.
+func WithBackups(n int) Option {
+	return func(o *options) {
+		o.backups = n
+	}
+}
+
+// WithoutMigrations opens the database at whatever schema version it is
+// stored in instead of migrating it to the latest one.
+func WithoutMigrations() Option {
+	return func(o *options) {
+		o.skipMigrations = true
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{backups: defaultBackups}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
 }
 
-func NewDB(path string) (*DB, error) {
+// NewDB opens the database file at path. The DB holds an exclusive lock on
+// <path>.lock until Close, so no other process can open it meanwhile.
+func NewDB(path string, opts ...Option) (*DB, error) {
+	o := newOptions(opts)
+	lock, err := lockFile(path + ".lock")
+	if err != nil {
+		return &DB{}, err
+	}
+	e := &fileEngine{path: path, backups: o.backups, lock: lock}
+	db, err := newDB(e, o)
+	if err == nil && e.primaryBad {
+		err = e.write(db.data, nil)
+	}
+	if err != nil {
+		lock.Close()
+		return &DB{}, err
+	}
+	return db, nil
+}
+
+// NewReadOnlyDB reads the database file at path as it is now. It takes no
+// lock, so it works while a server has the database open: the file is only
+// ever replaced atomically. Writes to the returned DB fail with ErrReadOnly.
+func NewReadOnlyDB(path string) (*DB, error) {
+	e := &fileEngine{path: path, backups: defaultBackups}
+	dbStructure, err := e.load()
+	if err != nil {
+		return &DB{}, err
+	}
+	return newReadOnlyDB(dbStructure)
+}
+
+// NewReadOnlyWALDB is NewReadOnlyDB for a database kept by NewWALDB.
+func NewReadOnlyWALDB(path string) (*DB, error) {
+	dbStructure, err := readWAL(path)
+	if err != nil {
+		return &DB{}, err
+	}
+	return newReadOnlyDB(dbStructure)
+}
+
+func newReadOnlyDB(dbStructure DBStructure) (*DB, error) {
+	err := checkSchemaVersion(dbStructure.SchemaVersion)
+	if err != nil {
+		return &DB{}, err
+	}
+	db := &DB{
+		engine: readOnlyEngine{},
+		mux:    &sync.RWMutex{},
+	}
+	db.setData(&dbStructure)
+	return db, nil
+}
+
+// NewMemoryDB returns a DB that never touches the disk, which is handy for
+// tests and throwaway servers.
+func NewMemoryDB() *DB {
+	db, _ := newDB(memoryEngine{}, newOptions(nil))
+	return db
+}
+
+func newDB(e engine, o options) (*DB, error) {
 	newDB := &DB{
-		path: path,
-		mux:  &sync.RWMutex{},
+		engine: e,
+		mux:    &sync.RWMutex{},
 	}
 	err := newDB.ensureDB()
 	if err != nil {
 		return &DB{}, err
 	}
+	err = checkSchemaVersion(newDB.data.SchemaVersion)
+	if err != nil {
+		return &DB{}, err
+	}
+	if !o.skipMigrations {
+		_, err = newDB.Migrate(false)
+		if err != nil {
+			return &DB{}, err
+		}
+	}
 	return newDB, nil
 }
 
 func (db *DB) createDB() error {
-	dbStructure := DBStructure{
-		Chirps: map[int]Chirp{},
-		Users:  map[int]User{},
+	dbStructure := DBStructure{SchemaVersion: LatestSchemaVersion()}
+	initTables(&dbStructure)
+	err := db.engine.write(&dbStructure, nil)
+	if err != nil {
+		return err
 	}
-	return db.writeDB(dbStructure)
+	db.setData(&dbStructure)
+	return nil
 }
 
 func (db *DB) ensureDB() error {
-	_, err := os.ReadFile(db.path)
+	err := db.reload()
 	if errors.Is(err, os.ErrNotExist) {
 		return db.createDB()
 	}
 	return err
 }
 
-func (db *DB) loadDB() (DBStructure, error) {
+func (db *DB) reload() error {
+	dbStructure, err := db.engine.load()
+	if err != nil {
+		return err
+	}
+	db.setData(&dbStructure)
+	return nil
+}
+
+func (db *DB) setData(dbStructure *DBStructure) {
+	db.data = dbStructure
+	db.idx = buildIndex(dbStructure)
+}
+
+// reloadIfStale picks up changes made to the stored copy by another process.
+func (db *DB) reloadIfStale() error {
 	db.mux.RLock()
-	defer db.mux.RUnlock()
+	stale := db.engine.stale()
+	db.mux.RUnlock()
+	if !stale {
+		return nil
+	}
 
-	dbStructure := DBStructure{}
-	data, err := os.ReadFile(db.path)
-	if errors.Is(err, os.ErrNotExist) {
-		return dbStructure, err
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	if !db.engine.stale() {
+		return nil
 	}
-	err = json.Unmarshal(data, &dbStructure)
+	return db.reload()
+}
+
+// View runs fn against the current state under the read lock. fn must not
+// modify what it sees; use Update for that.
+func (db *DB) View(fn func(tx *Tx) error) error {
+	err := db.reloadIfStale()
 	if err != nil {
-		return dbStructure, err
+		return err
 	}
-	return dbStructure, nil
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return fn(&Tx{DBStructure: db.data, idx: db.idx})
 }
 
-func (db *DB) writeDB(dbStructure DBStructure) error {
+// Update runs fn while holding the write lock, so no other Update can
+// interleave. When fn returns nil the rows it changed are handed to the
+// engine; when fn or the engine fails every change is undone.
+func (db *DB) Update(fn func(tx *Tx) error) error {
 	db.mux.Lock()
 	defer db.mux.Unlock()
 
-	dat, err := json.MarshalIndent(dbStructure, "", "\t")
-	if err != nil {
-		return err
+	if db.engine.stale() {
+		err := db.reload()
+		if err != nil {
+			return err
+		}
 	}
 
-	err = os.WriteFile(db.path, dat, 0600)
+	tx := &Tx{DBStructure: db.data, idx: db.idx}
+	err := fn(tx)
+	if err == nil && len(tx.changes) > 0 {
+		err = db.engine.write(db.data, tx.changes)
+	}
 	if err != nil {
+		if tx.rollback() {
+			db.idx = buildIndex(db.data)
+		}
 		return err
 	}
 	return nil
 }
+
+// Close releases the database, after which another process can open it.
+func (db *DB) Close() error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.engine.close()
+}
+
+// memoryEngine persists nothing; the DB's own copy is all there is.
+type memoryEngine struct{}
+
+func (memoryEngine) load() (DBStructure, error) {
+	return DBStructure{}, os.ErrNotExist
+}
+
+func (memoryEngine) write(dbStructure *DBStructure, changes []change) error {
+	return nil
+}
+
+func (memoryEngine) stale() bool {
+	return false
+}
+
+func (memoryEngine) close() error {
+	return nil
+}
+
+// readOnlyEngine holds a copy read once and refuses to store changes.
+type readOnlyEngine struct{}
+
+func (readOnlyEngine) load() (DBStructure, error) {
+	return DBStructure{}, os.ErrNotExist
+}
+
+func (readOnlyEngine) write(dbStructure *DBStructure, changes []change) error {
+	return ErrReadOnly
+}
+
+func (readOnlyEngine) stale() bool {
+	return false
+}
+
+func (readOnlyEngine) close() error {
+	return nil
+}
+
+func decodeDB(data []byte) (DBStructure, error) {
+	dbStructure := DBStructure{}
+	err := json.Unmarshal(data, &dbStructure)
+	if err != nil {
+		return dbStructure, err
+	}
+	initTables(&dbStructure)
+	return dbStructure, nil
+}
+
+// tableField finds the DBStructure field whose JSON name is table, so code
+// that treats tables generically works for every table, present or future.
+func tableField(dbStructure *DBStructure, table string) (reflect.Value, error) {
+	v := reflect.ValueOf(dbStructure).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		if name == table {
+			return v.Field(i), nil
+		}
+	}
+	return reflect.Value{}, fmt.Errorf("unknown table %q", table)
+}
+
+// initTables allocates every table missing from a decoded file.
+func initTables(dbStructure *DBStructure) {
+	v := reflect.ValueOf(dbStructure).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Map && field.IsNil() {
+			field.Set(reflect.MakeMap(field.Type()))
+		}
+	}
+}
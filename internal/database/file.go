@@ -0,0 +1,169 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fileEngine stores the database as one JSON document. Every write replaces
+// the document atomically and shifts the previous one into a ring of
+// numbered backups, which load falls back to when the primary is damaged.
+type fileEngine struct {
+	path    string
+	backups int
+	// primaryBad is set when load had to fall back to a backup.
+	primaryBad bool
+	// modTime and size describe the primary as last loaded or written.
+	modTime time.Time
+	size    int64
+	lock    *os.File
+}
+
+func (e *fileEngine) load() (DBStructure, error) {
+	e.remember()
+	dbStructure, err := readDBFile(e.path)
+	if err == nil {
+		e.primaryBad = false
+		return dbStructure, nil
+	}
+	for i := 1; i <= e.backups; i++ {
+		backup, backupErr := readDBFile(e.backupPath(i))
+		if backupErr == nil {
+			log.Printf("database: cannot read %s (%v), using %s", e.path, err, e.backupPath(i))
+			e.primaryBad = true
+			return backup, nil
+		}
+	}
+	return DBStructure{}, err
+}
+
+func (e *fileEngine) write(dbStructure *DBStructure, changes []change) error {
+	dat, err := json.MarshalIndent(dbStructure, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = e.rotate()
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(e.path, dat, 0600)
+	if err != nil {
+		return err
+	}
+	e.primaryBad = false
+	e.remember()
+	return nil
+}
+
+func (e *fileEngine) stale() bool {
+	info, err := os.Stat(e.path)
+	if err != nil {
+		// Nothing to reload from; the next write recreates the file.
+		return false
+	}
+	return !info.ModTime().Equal(e.modTime) || info.Size() != e.size
+}
+
+func (e *fileEngine) close() error {
+	return e.lock.Close()
+}
+
+func (e *fileEngine) remember() {
+	info, err := os.Stat(e.path)
+	if err != nil {
+		e.modTime, e.size = time.Time{}, 0
+		return
+	}
+	e.modTime, e.size = info.ModTime(), info.Size()
+}
+
+// rotate shifts <path>.1 … <path>.n-1 up by one and hard links the current
+// primary as <path>.1. The primary itself is never moved, so there is no
+// moment at which the database file is missing.
+func (e *fileEngine) rotate() error {
+	if e.backups <= 0 {
+		return nil
+	}
+	for i := e.backups; i > 1; i-- {
+		err := os.Rename(e.backupPath(i-1), e.backupPath(i))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	err := os.Remove(e.backupPath(1))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if e.primaryBad {
+		return nil
+	}
+
+	err = os.Link(e.path, e.backupPath(1))
+	if err == nil || errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	// Some filesystems do not support hard links; fall back to a copy.
+	dat, err := os.ReadFile(e.path)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(e.backupPath(1), dat, 0600)
+}
+
+func (e *fileEngine) backupPath(generation int) string {
+	return fmt.Sprintf("%s.%d", e.path, generation)
+}
+
+func readDBFile(path string) (DBStructure, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return DBStructure{}, err
+	}
+	return decodeDB(data)
+}
+
+// writeFileAtomic replaces path with data without ever exposing a partially
+// written file: the data goes to a temporary file in the same directory,
+// which is synced and then renamed over path.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), perm)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
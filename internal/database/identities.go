@@ -0,0 +1,137 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrLastLogin = errors.New("last way to log in")
+
+// Identity links an account at an external OpenID Connect provider to a
+// user. It is keyed by issuer and subject, which the provider promises never
+// to reassign; the email is only a hint of which account it was.
+type Identity struct {
+	Issuer   string    `json:"issuer"`
+	Subject  string    `json:"subject"`
+	UserID   int       `json:"user_id"`
+	Email    string    `json:"email"`
+	LinkedAt time.Time `json:"linked_at"`
+}
+
+func identityKey(issuer string, subject string) string {
+	return issuer + "#" + subject
+}
+
+func (db *DB) GetIdentity(issuer string, subject string) (Identity, error) {
+	identity := Identity{}
+	err := db.View(func(tx *Tx) error {
+		v, ok := tx.Identities[identityKey(issuer, subject)]
+		if !ok {
+			return ErrNotExist
+		}
+		identity = v
+		return nil
+	})
+	if err != nil {
+		return Identity{}, err
+	}
+	return identity, nil
+}
+
+// LinkIdentity links identity to identity.UserID. Linking it again to the
+// same user is a no-op; an identity linked to someone else is refused with
+// ErrAlreadyExists.
+func (db *DB) LinkIdentity(identity Identity) (Identity, error) {
+	err := db.Update(func(tx *Tx) error {
+		if _, ok := tx.Users[identity.UserID]; !ok {
+			return ErrNotExist
+		}
+		if v, ok := tx.Identities[identityKey(identity.Issuer, identity.Subject)]; ok {
+			if v.UserID != identity.UserID {
+				return ErrAlreadyExists
+			}
+			identity = v
+			return nil
+		}
+		identity.LinkedAt = time.Now().UTC()
+		tx.putIdentity(identity)
+		return nil
+	})
+	if err != nil {
+		return Identity{}, err
+	}
+	return identity, nil
+}
+
+// CreateIdentityUser creates a user without a password for an identity the
+// provider vouched for, verified email included, and links the two.
+func (db *DB) CreateIdentityUser(email string, identity Identity) (User, error) {
+	user := User{}
+	err := db.Update(func(tx *Tx) error {
+		if _, ok := tx.userByEmail(email); ok {
+			return ErrAlreadyExists
+		}
+		if _, ok := tx.Identities[identityKey(identity.Issuer, identity.Subject)]; ok {
+			return ErrAlreadyExists
+		}
+		id := tx.nextID(tableUsers)
+		user = User{
+			ID:            id,
+			Email:         email,
+			Role:          RoleUser,
+			EmailVerified: true,
+			Handle:        tx.defaultHandle(id),
+		}
+		tx.putUser(user)
+		identity.UserID = user.ID
+		identity.LinkedAt = time.Now().UTC()
+		tx.putIdentity(identity)
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (db *DB) ListIdentities(userID int) ([]Identity, error) {
+	identities := []Identity{}
+	err := db.View(func(tx *Tx) error {
+		for _, v := range tx.Identities {
+			if v.UserID == userID {
+				identities = append(identities, v)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return []Identity{}, err
+	}
+	return identities, nil
+}
+
+// UnlinkIdentity removes a link of the user. It refuses with ErrLastLogin to
+// remove the only way left to log in: the last identity of a user without a
+// password.
+func (db *DB) UnlinkIdentity(issuer string, subject string, userID int) error {
+	return db.Update(func(tx *Tx) error {
+		key := identityKey(issuer, subject)
+		v, ok := tx.Identities[key]
+		if !ok || v.UserID != userID {
+			return ErrNotExist
+		}
+		if tx.Users[userID].Password == "" {
+			linked := 0
+			for _, w := range tx.Identities {
+				if w.UserID == userID {
+					linked++
+				}
+			}
+			if linked == 1 {
+				return ErrLastLogin
+			}
+		}
+		tx.deleteIdentity(key)
+		return nil
+	})
+}
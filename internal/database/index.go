@@ -0,0 +1,100 @@
+package database
+
+import "strings"
+
+// index holds the secondary lookups that would otherwise need a scan of a
+// whole table. It is derived data: never persisted, built from the tables on
+// load and kept current by the Tx put and delete helpers.
+type index struct {
+	userByEmail    map[string]int
+	userByHandle   map[string]int
+	chirpsByAuthor map[int]map[int]struct{}
+}
+
+func buildIndex(dbStructure *DBStructure) *index {
+	idx := &index{
+		userByEmail:    make(map[string]int, len(dbStructure.Users)),
+		userByHandle:   make(map[string]int, len(dbStructure.Users)),
+		chirpsByAuthor: map[int]map[int]struct{}{},
+	}
+	for _, user := range dbStructure.Users {
+		idx.addUser(user)
+	}
+	for _, chirp := range dbStructure.Chirps {
+		idx.addChirp(chirp)
+	}
+	return idx
+}
+
+// emailKey is the index key for an email. Lookups are case-insensitive.
+func emailKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// handleKey is the index key for a handle. Lookups are case-insensitive.
+func handleKey(handle string) string {
+	return strings.ToLower(handle)
+}
+
+func (idx *index) addUser(user User) {
+	// Deleted accounts have no email or handle left to find them by.
+	if user.Email != "" {
+		idx.userByEmail[emailKey(user.Email)] = user.ID
+	}
+	if user.Handle != "" {
+		idx.userByHandle[handleKey(user.Handle)] = user.ID
+	}
+}
+
+func (idx *index) removeUser(user User) {
+	if idx.userByEmail[emailKey(user.Email)] == user.ID {
+		delete(idx.userByEmail, emailKey(user.Email))
+	}
+	if idx.userByHandle[handleKey(user.Handle)] == user.ID {
+		delete(idx.userByHandle, handleKey(user.Handle))
+	}
+}
+
+func (idx *index) addChirp(chirp Chirp) {
+	ids, ok := idx.chirpsByAuthor[chirp.AuthorID]
+	if !ok {
+		ids = map[int]struct{}{}
+		idx.chirpsByAuthor[chirp.AuthorID] = ids
+	}
+	ids[chirp.ID] = struct{}{}
+}
+
+func (idx *index) removeChirp(chirp Chirp) {
+	ids := idx.chirpsByAuthor[chirp.AuthorID]
+	delete(ids, chirp.ID)
+	if len(ids) == 0 {
+		delete(idx.chirpsByAuthor, chirp.AuthorID)
+	}
+}
+
+func (tx *Tx) userByEmail(email string) (User, bool) {
+	id, ok := tx.idx.userByEmail[emailKey(email)]
+	if !ok {
+		return User{}, false
+	}
+	user, ok := tx.Users[id]
+	return user, ok
+}
+
+func (tx *Tx) userByHandle(handle string) (User, bool) {
+	id, ok := tx.idx.userByHandle[handleKey(handle)]
+	if !ok {
+		return User{}, false
+	}
+	user, ok := tx.Users[id]
+	return user, ok
+}
+
+func (tx *Tx) chirpsByAuthor(authorID int) []Chirp {
+	ids := tx.idx.chirpsByAuthor[authorID]
+	chirps := make([]Chirp, 0, len(ids))
+	for id := range ids {
+		chirps = append(chirps, tx.Chirps[id])
+	}
+	return chirps
+}
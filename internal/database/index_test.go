@@ -0,0 +1,59 @@
+package database
+
+import (
+	"fmt"
+	"testing"
+)
+
+var benchmarkSizes = []int{100, 10_000, 100_000}
+
+// seedDB returns an in-memory DB with n users and n chirps spread over them,
+// ten per author.
+func seedDB(b *testing.B, n int) *DB {
+	b.Helper()
+	db := NewMemoryDB()
+	err := db.Update(func(tx *Tx) error {
+		for i := 1; i <= n; i++ {
+			tx.putUser(User{ID: i, Email: fmt.Sprintf("user%d@example.com", i), Role: RoleUser})
+			tx.putChirp(Chirp{ID: i, Body: "chirp", AuthorID: (i-1)/10 + 1})
+		}
+		tx.putSequence(tableUsers, n)
+		tx.putSequence(tableChirps, n)
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return db
+}
+
+func BenchmarkGetUserByEmail(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprintf("users=%d", n), func(b *testing.B) {
+			db := seedDB(b, n)
+			email := fmt.Sprintf("USER%d@example.com", n/2+1)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := db.GetUserByEmail(email)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetChirpsByAuthor(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprintf("chirps=%d", n), func(b *testing.B) {
+			db := seedDB(b, n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				chirps, err := db.GetChirpsByAuthor(1)
+				if err != nil || len(chirps) != 10 {
+					b.Fatalf("GetChirpsByAuthor(1) = %d chirps, %v", len(chirps), err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"errors"
+	"slices"
+)
+
+var ErrAlreadyUsed = errors.New("already used")
+
+// SetTOTPSecret starts, or restarts, TOTP enrolment. Login is unaffected
+// until ConfirmTOTP.
+func (db *DB) SetTOTPSecret(userID int, secret string) (User, error) {
+	return db.updateUser(userID, func(user *User) error {
+		if user.TOTPEnabled {
+			return ErrAlreadyExists
+		}
+		user.TOTPSecret = secret
+		return nil
+	})
+}
+
+// ConfirmTOTP turns TOTP on once the user proved their app produces codes
+// for the pending secret at step, and stores the recovery code hashes.
+func (db *DB) ConfirmTOTP(userID int, step int64, recoveryHashes []string) (User, error) {
+	return db.updateUser(userID, func(user *User) error {
+		if user.TOTPSecret == "" {
+			return ErrNotExist
+		}
+		user.TOTPEnabled = true
+		user.TOTPLastStep = step
+		user.RecoveryCodes = recoveryHashes
+		return nil
+	})
+}
+
+func (db *DB) DisableTOTP(userID int) (User, error) {
+	return db.updateUser(userID, func(user *User) error {
+		user.TOTPSecret = ""
+		user.TOTPEnabled = false
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = nil
+		return nil
+	})
+}
+
+// UseTOTPStep accepts a TOTP code's time step at most once: a step that is
+// not newer than the last accepted one fails with ErrAlreadyUsed.
+func (db *DB) UseTOTPStep(userID int, step int64) error {
+	_, err := db.updateUser(userID, func(user *User) error {
+		if step <= user.TOTPLastStep {
+			return ErrAlreadyUsed
+		}
+		user.TOTPLastStep = step
+		return nil
+	})
+	return err
+}
+
+// UseRecoveryCode spends the recovery code with the given hash.
+func (db *DB) UseRecoveryCode(userID int, hash string) error {
+	_, err := db.updateUser(userID, func(user *User) error {
+		i := slices.Index(user.RecoveryCodes, hash)
+		if i < 0 {
+			return ErrNotExist
+		}
+		user.RecoveryCodes = slices.Delete(slices.Clone(user.RecoveryCodes), i, i+1)
+		return nil
+	})
+	return err
+}
+
+// updateUser applies fn to the stored user and saves the result unless fn
+// fails.
+func (db *DB) updateUser(id int, fn func(user *User) error) (User, error) {
+	user := User{}
+	err := db.Update(func(tx *Tx) error {
+		v, ok := tx.Users[id]
+		if !ok {
+			return ErrNotExist
+		}
+		err := fn(&v)
+		if err != nil {
+			return err
+		}
+		tx.putUser(v)
+		user = v
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
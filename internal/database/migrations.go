@@ -0,0 +1,171 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Migration upgrades a stored database from Version-1 to Version. Up works on
+// the decoded structure, so it is where fields added after a file was written
+// get their real values instead of Go's zero values. Like any Update, it must
+// write through the Tx helpers.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(tx *Tx) error
+}
+
+// migrations must stay ordered by Version, starting at 1 with no gaps. Never
+// edit one that has shipped; add a new one instead.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "seed per-table ID sequences from the highest existing IDs",
+		Up:          migrateSeedSequences,
+	},
+	{
+		Version:     2,
+		Description: "set last_seen_at of existing sessions to their creation time",
+		Up:          migrateSessionLastSeen,
+	},
+	{
+		Version:     3,
+		Description: "give existing users the user role",
+		Up:          migrateUserRoles,
+	},
+	{
+		Version:     4,
+		Description: "give existing users a default handle",
+		Up:          migrateUserHandles,
+	},
+}
+
+var (
+	errRollback = errors.New("transaction rolled back")
+	// ErrSchemaTooNew is returned for a database written by a newer build,
+	// which this one would misread.
+	ErrSchemaTooNew = errors.New("database schema is newer than this build supports")
+)
+
+func LatestSchemaVersion() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+func checkSchemaVersion(version int) error {
+	if version > LatestSchemaVersion() {
+		return fmt.Errorf("%w: version %d, latest known %d", ErrSchemaTooNew, version, LatestSchemaVersion())
+	}
+	return nil
+}
+
+func (db *DB) SchemaVersion() (int, error) {
+	version := 0
+	err := db.View(func(tx *Tx) error {
+		version = tx.SchemaVersion
+		return nil
+	})
+	return version, err
+}
+
+// PendingMigrations lists the migrations Migrate would apply.
+func (db *DB) PendingMigrations() ([]Migration, error) {
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	return pendingMigrations(version), nil
+}
+
+// Migrate applies every pending migration in one transaction and returns the
+// ones it applied. With dryRun the migrations still run, so failures surface,
+// but nothing is persisted.
+func (db *DB) Migrate(dryRun bool) ([]Migration, error) {
+	applied := []Migration{}
+	err := db.Update(func(tx *Tx) error {
+		err := checkSchemaVersion(tx.SchemaVersion)
+		if err != nil {
+			return err
+		}
+		for _, m := range pendingMigrations(tx.SchemaVersion) {
+			err := m.Up(tx)
+			if err != nil {
+				return err
+			}
+			tx.setSchemaVersion(m.Version)
+			applied = append(applied, m)
+		}
+		if dryRun {
+			return errRollback
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errRollback) {
+		return nil, err
+	}
+	return applied, nil
+}
+
+func pendingMigrations(version int) []Migration {
+	pending := []Migration{}
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+func migrateSeedSequences(tx *Tx) error {
+	for id := range tx.Chirps {
+		if id > tx.Sequences[tableChirps] {
+			tx.putSequence(tableChirps, id)
+		}
+	}
+	for id := range tx.Users {
+		if id > tx.Sequences[tableUsers] {
+			tx.putSequence(tableUsers, id)
+		}
+	}
+	return nil
+}
+
+func migrateSessionLastSeen(tx *Tx) error {
+	for _, session := range tx.Sessions {
+		if session.LastSeenAt.IsZero() {
+			session.LastSeenAt = session.CreatedAt
+			tx.putSession(session)
+		}
+	}
+	return nil
+}
+
+func migrateUserRoles(tx *Tx) error {
+	for _, user := range tx.Users {
+		if user.Role == "" {
+			user.Role = RoleUser
+			tx.putUser(user)
+		}
+	}
+	return nil
+}
+
+func migrateUserHandles(tx *Tx) error {
+	ids := make([]int, 0, len(tx.Users))
+	for id, user := range tx.Users {
+		if user.Handle == "" && user.DeletedAt == nil {
+			ids = append(ids, id)
+		}
+	}
+	// In ID order, so who gets a contested default handle is deterministic.
+	slices.Sort(ids)
+	for _, id := range ids {
+		user := tx.Users[id]
+		user.Handle = tx.defaultHandle(id)
+		tx.putUser(user)
+	}
+	return nil
+}
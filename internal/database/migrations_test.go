@@ -0,0 +1,90 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSchemaTooNew(t *testing.T) {
+	newer := fmt.Sprintf(`{"schema_version": %d, "chirps": {}}`, LatestSchemaVersion()+1)
+	forEachEngine(t, func(t *testing.T, db *DB, reopen func() *DB) {
+		_, err := db.CreateChirp("kept", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.Restore(strings.NewReader(newer))
+		if !errors.Is(err, ErrSchemaTooNew) {
+			t.Errorf("Restore of a newer schema: err = %v, want ErrSchemaTooNew", err)
+		}
+		db = reopen()
+		chirps, err := db.GetChirps()
+		if err != nil || len(chirps) != 1 {
+			t.Errorf("chirps after a refused restore = %v, %v; want the one created", chirps, err)
+		}
+	})
+
+	for _, e := range engines {
+		if !e.persistent {
+			continue
+		}
+		t.Run("open/"+e.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database.json")
+			err := os.WriteFile(path, []byte(newer), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, opts := range [][]Option{nil, {WithoutMigrations()}} {
+				_, err = e.open(path, opts...)
+				if !errors.Is(err, ErrSchemaTooNew) {
+					t.Errorf("opening a newer schema: err = %v, want ErrSchemaTooNew", err)
+				}
+			}
+		})
+	}
+}
+
+// An older build must refuse a log written by a newer one rather than take
+// its unknown records for damage.
+func TestSchemaTooNewInWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewWALDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateChirp("kept", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	newer := fmt.Sprintf("{\"op\":\"put\",\"table\":\"future_rows\",\"key\":\"1\",\"value\":{}}\n{\"op\":\"put\",\"table\":\"schema_version\",\"value\":%d}\n", LatestSchemaVersion()+1)
+	log, err := os.OpenFile(path+".wal", os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = log.WriteString(newer)
+	log.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(path + ".wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewWALDB(path)
+	if !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("opening a log with a newer schema: err = %v, want ErrSchemaTooNew", err)
+	}
+	after, err := os.ReadFile(path + ".wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Errorf("log changed from %d to %d bytes by the refused open", len(before), len(after))
+	}
+}
@@ -0,0 +1,189 @@
+package database
+
+import "time"
+
+// OAuthClient is a third-party app registered by a user. Public clients,
+// such as native and browser apps, have no secret.
+type OAuthClient struct {
+	ID           string    `json:"id"`
+	SecretHash   string    `json:"secret_hash,omitempty"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	OwnerID      int       `json:"owner_id"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// AuthCode is an authorization code, stored under its hash. Once exchanged
+// it is kept until it expires, with the session it was exchanged for, so a
+// second exchange can be caught.
+type AuthCode struct {
+	Hash          string     `json:"hash"`
+	ClientID      string     `json:"client_id"`
+	UserID        int        `json:"user_id"`
+	RedirectURI   string     `json:"redirect_uri"`
+	Scopes        []string   `json:"scopes"`
+	CodeChallenge string     `json:"code_challenge"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	UsedAt        *time.Time `json:"used_at,omitempty"`
+	SessionID     int        `json:"session_id,omitempty"`
+}
+
+func (db *DB) CreateOAuthClient(client OAuthClient) (OAuthClient, error) {
+	err := db.Update(func(tx *Tx) error {
+		if _, ok := tx.OAuthClients[client.ID]; ok {
+			return ErrAlreadyExists
+		}
+		if _, ok := tx.Users[client.OwnerID]; !ok {
+			return ErrNotExist
+		}
+		client.CreatedAt = time.Now().UTC()
+		tx.putOAuthClient(client)
+		return nil
+	})
+	if err != nil {
+		return OAuthClient{}, err
+	}
+	return client, nil
+}
+
+func (db *DB) GetOAuthClient(id string) (OAuthClient, error) {
+	client := OAuthClient{}
+	err := db.View(func(tx *Tx) error {
+		v, ok := tx.OAuthClients[id]
+		if !ok {
+			return ErrNotExist
+		}
+		client = v
+		return nil
+	})
+	if err != nil {
+		return OAuthClient{}, err
+	}
+	return client, nil
+}
+
+func (db *DB) ListOAuthClients(ownerID int) ([]OAuthClient, error) {
+	clients := []OAuthClient{}
+	err := db.View(func(tx *Tx) error {
+		for _, v := range tx.OAuthClients {
+			if v.OwnerID == ownerID {
+				clients = append(clients, v)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return []OAuthClient{}, err
+	}
+	return clients, nil
+}
+
+// DeleteOAuthClient removes one of the owner's clients and revokes every
+// session granted to it.
+func (db *DB) DeleteOAuthClient(id string, ownerID int) error {
+	return db.Update(func(tx *Tx) error {
+		v, ok := tx.OAuthClients[id]
+		if !ok || v.OwnerID != ownerID {
+			return ErrNotExist
+		}
+		tx.removeOAuthClient(id)
+		return nil
+	})
+}
+
+// removeOAuthClient deletes a client, revoking the sessions granted to it and
+// dropping its codes.
+func (tx *Tx) removeOAuthClient(id string) {
+	tx.deleteOAuthClient(id)
+	now := time.Now().UTC()
+	for _, session := range tx.Sessions {
+		if session.ClientID == id && session.RevokedAt == nil {
+			session.RevokedAt = &now
+			tx.putSession(session)
+		}
+	}
+	for hash, code := range tx.AuthCodes {
+		if code.ClientID == id {
+			tx.deleteAuthCode(hash)
+		}
+	}
+}
+
+func (db *DB) CreateAuthCode(code AuthCode) error {
+	return db.Update(func(tx *Tx) error {
+		if _, ok := tx.OAuthClients[code.ClientID]; !ok {
+			return ErrNotExist
+		}
+		tx.putAuthCode(code)
+		return nil
+	})
+}
+
+// ExchangeAuthCode spends the authorization code stored under hash for
+// clientID and opens a session for the client with the code's user and
+// scopes. check sees the code first and can refuse it, say for a wrong PKCE
+// verifier. Exchanging a code twice revokes the session the first exchange
+// opened, which is committed, and returns ErrTokenReused.
+func (db *DB) ExchangeAuthCode(hash string, clientID string, check func(code AuthCode) error, session Session, refreshHash string, expiresAt time.Time) (Session, error) {
+	reused := false
+	err := db.Update(func(tx *Tx) error {
+		code, ok := tx.AuthCodes[hash]
+		if !ok || code.ClientID != clientID {
+			return ErrNotExist
+		}
+		now := time.Now().UTC()
+		if code.UsedAt != nil {
+			if v, ok := tx.Sessions[code.SessionID]; ok && v.RevokedAt == nil {
+				v.RevokedAt = &now
+				tx.putSession(v)
+			}
+			reused = true
+			return nil
+		}
+		if now.After(code.ExpiresAt) {
+			return ErrExpired
+		}
+		err := check(code)
+		if err != nil {
+			return err
+		}
+
+		session.UserID = code.UserID
+		session.ClientID = code.ClientID
+		session.Scopes = code.Scopes
+		session, err = tx.createSession(session, refreshHash, expiresAt)
+		if err != nil {
+			return err
+		}
+		code.UsedAt = &now
+		code.SessionID = session.ID
+		tx.putAuthCode(code)
+		return nil
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	if reused {
+		return Session{}, ErrTokenReused
+	}
+	return session, nil
+}
+
+// PurgeExpiredAuthCodes drops authorization codes that expired before the
+// given time, exchanged or not.
+func (db *DB) PurgeExpiredAuthCodes(before time.Time) (int, error) {
+	purged := 0
+	err := db.Update(func(tx *Tx) error {
+		for hash, code := range tx.AuthCodes {
+			if code.ExpiresAt.Before(before) {
+				tx.deleteAuthCode(hash)
+				purged++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
@@ -0,0 +1,330 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// Session is one login on one device. Its refresh tokens form a family: each
+// refresh replaces the current token with a new one, and presenting a token
+// that was already replaced revokes the whole session.
+type Session struct {
+	ID          int        `json:"id"`
+	UserID      int        `json:"user_id"`
+	DeviceLabel string     `json:"device_label"`
+	IP          string     `json:"ip"`
+	UserAgent   string     `json:"user_agent"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastSeenAt  time.Time  `json:"last_seen_at"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+	// ClientID and Scopes are set for sessions granted to an OAuth client
+	// rather than opened by logging in.
+	ClientID string   `json:"client_id,omitempty"`
+	Scopes   []string `json:"scopes,omitempty"`
+}
+
+// RefreshToken is stored under the SHA-256 of the opaque token, never the
+// token itself.
+type RefreshToken struct {
+	Hash      string     `json:"hash"`
+	SessionID int        `json:"session_id"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+}
+
+var (
+	ErrRevoked     = errors.New("session revoked")
+	ErrExpired     = errors.New("token expired")
+	ErrTokenReused = errors.New("refresh token reused")
+)
+
+// CreateSession stores a new session for the user and device described by
+// session, along with its first refresh token.
+func (db *DB) CreateSession(session Session, refreshHash string, expiresAt time.Time) (Session, error) {
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		session, err = tx.createSession(session, refreshHash, expiresAt)
+		return err
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
+func (tx *Tx) createSession(session Session, refreshHash string, expiresAt time.Time) (Session, error) {
+	if _, ok := tx.Users[session.UserID]; !ok {
+		return Session{}, ErrNotExist
+	}
+	now := time.Now().UTC()
+	session.ID = tx.nextID(tableSessions)
+	session.CreatedAt = now
+	session.LastSeenAt = now
+	session.RevokedAt = nil
+	tx.putSession(session)
+	tx.putRefreshToken(RefreshToken{
+		Hash:      refreshHash,
+		SessionID: session.ID,
+		ExpiresAt: expiresAt,
+	})
+	return session, nil
+}
+
+func (db *DB) GetSession(id int) (Session, error) {
+	session := Session{}
+	err := db.View(func(tx *Tx) error {
+		v, ok := tx.Sessions[id]
+		if !ok {
+			return ErrNotExist
+		}
+		session = v
+		return nil
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
+// RotateRefreshToken spends the refresh token stored under oldHash and
+// stores newHash in its place. Spending a token twice is taken as theft: the
+// session is revoked, which is committed, and ErrTokenReused is returned.
+func (db *DB) RotateRefreshToken(oldHash string, newHash string, expiresAt time.Time) (Session, error) {
+	session := Session{}
+	reused := false
+	err := db.Update(func(tx *Tx) error {
+		token, ok := tx.RefreshTokens[oldHash]
+		if !ok {
+			return ErrNotExist
+		}
+		session, ok = tx.Sessions[token.SessionID]
+		if !ok {
+			return ErrNotExist
+		}
+		if session.RevokedAt != nil {
+			return ErrRevoked
+		}
+
+		now := time.Now().UTC()
+		if token.UsedAt != nil {
+			session.RevokedAt = &now
+			tx.putSession(session)
+			reused = true
+			return nil
+		}
+		if now.After(token.ExpiresAt) {
+			return ErrExpired
+		}
+
+		token.UsedAt = &now
+		tx.putRefreshToken(token)
+		session.LastSeenAt = now
+		tx.putSession(session)
+		tx.putRefreshToken(RefreshToken{
+			Hash:      newHash,
+			SessionID: session.ID,
+			ExpiresAt: expiresAt,
+		})
+		return nil
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	if reused {
+		return Session{}, ErrTokenReused
+	}
+	return session, nil
+}
+
+// GetSessionByToken returns the refresh token stored under refreshHash and
+// the session it belongs to, whether or not either is still valid.
+func (db *DB) GetSessionByToken(refreshHash string) (Session, RefreshToken, error) {
+	session := Session{}
+	token := RefreshToken{}
+	err := db.View(func(tx *Tx) error {
+		var ok bool
+		token, ok = tx.RefreshTokens[refreshHash]
+		if !ok {
+			return ErrNotExist
+		}
+		session, ok = tx.Sessions[token.SessionID]
+		if !ok {
+			return ErrNotExist
+		}
+		return nil
+	})
+	if err != nil {
+		return Session{}, RefreshToken{}, err
+	}
+	return session, token, nil
+}
+
+// RevokeSessionByToken revokes the session the refresh token belongs to.
+func (db *DB) RevokeSessionByToken(refreshHash string) (Session, error) {
+	session := Session{}
+	err := db.Update(func(tx *Tx) error {
+		token, ok := tx.RefreshTokens[refreshHash]
+		if !ok {
+			return ErrNotExist
+		}
+		v, ok := tx.Sessions[token.SessionID]
+		if !ok {
+			return ErrNotExist
+		}
+		if v.RevokedAt == nil {
+			now := time.Now().UTC()
+			v.RevokedAt = &now
+			tx.putSession(v)
+		}
+		session = v
+		return nil
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
+// ListSessions returns the user's sessions that can still be refreshed:
+// not revoked, and holding a refresh token that is neither spent nor
+// expired.
+func (db *DB) ListSessions(userID int) ([]Session, error) {
+	sessions := []Session{}
+	err := db.View(func(tx *Tx) error {
+		live := tx.liveSessions(time.Now())
+		for _, v := range tx.Sessions {
+			if v.UserID == userID && v.RevokedAt == nil && live[v.ID] {
+				sessions = append(sessions, v)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return []Session{}, err
+	}
+	return sessions, nil
+}
+
+// SessionActivity is when and from where a session was last used.
+type SessionActivity struct {
+	At time.Time
+	IP string
+}
+
+// RecordActivity stores last-seen times of sessions and last-used times of
+// API keys gathered in memory, all in one write. Sessions and keys deleted
+// in the meantime are skipped.
+func (db *DB) RecordActivity(sessions map[int]SessionActivity, apiKeys map[string]time.Time) error {
+	if len(sessions) == 0 && len(apiKeys) == 0 {
+		return nil
+	}
+	return db.Update(func(tx *Tx) error {
+		for id, seen := range sessions {
+			v, ok := tx.Sessions[id]
+			if !ok || seen.At.Before(v.LastSeenAt) {
+				continue
+			}
+			v.LastSeenAt = seen.At.UTC()
+			v.IP = seen.IP
+			tx.putSession(v)
+		}
+		for hash, at := range apiKeys {
+			v, ok := tx.APIKeys[hash]
+			if !ok {
+				continue
+			}
+			at = at.UTC()
+			v.LastUsedAt = &at
+			tx.putAPIKey(v)
+		}
+		return nil
+	})
+}
+
+// RevokeSession revokes one of the user's sessions. Sessions of other users
+// are reported as not existing.
+func (db *DB) RevokeSession(id int, userID int) (Session, error) {
+	session := Session{}
+	err := db.Update(func(tx *Tx) error {
+		v, ok := tx.Sessions[id]
+		if !ok || v.UserID != userID || v.RevokedAt != nil {
+			return ErrNotExist
+		}
+		now := time.Now().UTC()
+		v.RevokedAt = &now
+		tx.putSession(v)
+		session = v
+		return nil
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
+// RevokeAllSessions revokes every session of the user and reports how many
+// were still active.
+func (db *DB) RevokeAllSessions(userID int) (int, error) {
+	revoked := 0
+	err := db.Update(func(tx *Tx) error {
+		revoked = tx.revokeUserSessions(userID, 0)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return revoked, nil
+}
+
+// revokeUserSessions revokes every session of the user except keepID.
+func (tx *Tx) revokeUserSessions(userID int, keepID int) int {
+	revoked := 0
+	now := time.Now().UTC()
+	for _, v := range tx.Sessions {
+		if v.UserID == userID && v.ID != keepID && v.RevokedAt == nil {
+			v.RevokedAt = &now
+			tx.putSession(v)
+			revoked++
+		}
+	}
+	return revoked
+}
+
+// liveSessions is the set of sessions with a refresh token that is neither
+// spent nor expired at now.
+func (tx *Tx) liveSessions(now time.Time) map[int]bool {
+	live := map[int]bool{}
+	for _, token := range tx.RefreshTokens {
+		if token.UsedAt == nil && token.ExpiresAt.After(now) {
+			live[token.SessionID] = true
+		}
+	}
+	return live
+}
+
+// PurgeExpiredSessions deletes sessions that were revoked or whose refresh
+// tokens all expired before the given time, together with their tokens, and
+// returns how many sessions went. Spent tokens of live sessions are kept
+// until they expire so reuse is still detected.
+func (db *DB) PurgeExpiredSessions(before time.Time) (int, error) {
+	purged := 0
+	err := db.Update(func(tx *Tx) error {
+		for hash, token := range tx.RefreshTokens {
+			if token.ExpiresAt.Before(before) {
+				tx.deleteRefreshToken(hash)
+			}
+		}
+		live := tx.liveSessions(before)
+		for id, v := range tx.Sessions {
+			if v.RevokedAt != nil || !live[id] {
+				tx.deleteSession(id)
+				purged++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
@@ -0,0 +1,97 @@
+package database
+
+import (
+	"io"
+	"time"
+)
+
+// Store is everything the HTTP layer needs from persistence. *DB satisfies
+// it for both the JSON file and the in-memory engines.
+type Store interface {
+	UserStore
+	ChirpStore
+	TokenStore
+	BackupStore
+	OAuthStore
+	IdentityStore
+	APIKeyStore
+}
+
+type UserStore interface {
+	CreateUser(email string, hashedPassword string) (User, error)
+	GetUser(id int) (User, error)
+	GetUserByEmail(email string) (User, error)
+	GetUserByHandle(handle string) (User, error)
+	UpdateUser(id int, update UserUpdate) (User, error)
+	UpdateWebhook(id int) (User, error)
+	UpgradePasswordHash(id int, oldHash string, newHash string) error
+	SetUserRole(id int, role string) (User, error)
+	SetTOTPSecret(userID int, secret string) (User, error)
+	ConfirmTOTP(userID int, step int64, recoveryHashes []string) (User, error)
+	DisableTOTP(userID int) (User, error)
+	UseTOTPStep(userID int, step int64) error
+	UseRecoveryCode(userID int, hash string) error
+	DeleteUser(id int, anonymize bool) error
+}
+
+type ChirpStore interface {
+	CreateChirp(post string, authorID int) (Chirp, error)
+	GetChirps() ([]Chirp, error)
+	GetChirpsByAuthor(authorID int) ([]Chirp, error)
+	GetChirpByID(ID int) (Chirp, error)
+	DeleteChirp(ID int, authorID int) (Chirp, error)
+	ModerateChirp(ID int, moderatorID int) (Chirp, error)
+	GetDeletedChirp(ID int) (Chirp, error)
+	GetDeletedChirpsByAuthor(authorID int) ([]Chirp, error)
+	RestoreChirp(ID int) (Chirp, error)
+	PurgeDeletedChirps(before time.Time) (int, error)
+}
+
+type TokenStore interface {
+	CreateSession(session Session, refreshHash string, expiresAt time.Time) (Session, error)
+	GetSession(id int) (Session, error)
+	ListSessions(userID int) ([]Session, error)
+	RevokeSession(id int, userID int) (Session, error)
+	RevokeAllSessions(userID int) (int, error)
+	RotateRefreshToken(oldHash string, newHash string, expiresAt time.Time) (Session, error)
+	GetSessionByToken(refreshHash string) (Session, RefreshToken, error)
+	RevokeSessionByToken(refreshHash string) (Session, error)
+	PurgeExpiredSessions(before time.Time) (int, error)
+	RecordActivity(sessions map[int]SessionActivity, apiKeys map[string]time.Time) error
+	ResetPassword(token UsedToken, email string, hashedPassword string) (User, error)
+	VerifyEmail(token UsedToken, email string) (User, error)
+	PurgeUsedTokens(before time.Time) (int, error)
+}
+
+type OAuthStore interface {
+	CreateOAuthClient(client OAuthClient) (OAuthClient, error)
+	GetOAuthClient(id string) (OAuthClient, error)
+	ListOAuthClients(ownerID int) ([]OAuthClient, error)
+	DeleteOAuthClient(id string, ownerID int) error
+	CreateAuthCode(code AuthCode) error
+	ExchangeAuthCode(hash string, clientID string, check func(code AuthCode) error, session Session, refreshHash string, expiresAt time.Time) (Session, error)
+	PurgeExpiredAuthCodes(before time.Time) (int, error)
+}
+
+type IdentityStore interface {
+	GetIdentity(issuer string, subject string) (Identity, error)
+	LinkIdentity(identity Identity) (Identity, error)
+	CreateIdentityUser(email string, identity Identity) (User, error)
+	ListIdentities(userID int) ([]Identity, error)
+	UnlinkIdentity(issuer string, subject string, userID int) error
+}
+
+type APIKeyStore interface {
+	CreateAPIKey(key APIKey) (APIKey, error)
+	GetAPIKeyByHash(hash string) (APIKey, error)
+	ListAPIKeys(userID int) ([]APIKey, error)
+	DeleteAPIKey(id int, userID int) error
+	PurgeExpiredAPIKeys(before time.Time) (int, error)
+}
+
+type BackupStore interface {
+	Snapshot(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+var _ Store = (*DB)(nil)
@@ -0,0 +1,355 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// engines opens a DB at path with each engine. Reopening the same path with
+// a persistent engine must give back what was committed.
+var engines = []struct {
+	name       string
+	open       func(path string, opts ...Option) (*DB, error)
+	persistent bool
+	// openReadOnly reads what open stored, nil for the memory engine.
+	openReadOnly func(path string) (*DB, error)
+}{
+	{"file", NewDB, true, NewReadOnlyDB},
+	{"wal", NewWALDB, true, NewReadOnlyWALDB},
+	{"memory", func(string, ...Option) (*DB, error) { return NewMemoryDB(), nil }, false, nil},
+}
+
+// forEachEngine runs fn once per engine against a fresh database. reopen
+// opens the database again the way a restarted server would.
+func forEachEngine(t *testing.T, fn func(t *testing.T, db *DB, reopen func() *DB)) {
+	for _, e := range engines {
+		t.Run(e.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database.json")
+			db := openTestDB(t, e.open, path)
+			reopen := func() *DB {
+				if !e.persistent {
+					return db
+				}
+				err := db.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				db = openTestDB(t, e.open, path)
+				return db
+			}
+			fn(t, db, reopen)
+			db.Close()
+		})
+	}
+}
+
+func openTestDB(t *testing.T, open func(path string, opts ...Option) (*DB, error), path string) *DB {
+	t.Helper()
+	db, err := open(path)
+	if err != nil {
+		t.Fatalf("opening %s: %v", path, err)
+	}
+	return db
+}
+
+func TestStoreUsers(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, db *DB, reopen func() *DB) {
+		user, err := db.CreateUser("Alice@example.com", "hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.ID != 1 || user.Role != RoleUser || user.Handle != "user1" {
+			t.Errorf("CreateUser = %+v", user)
+		}
+		_, err = db.CreateUser("alice@EXAMPLE.com", "hash")
+		if !errors.Is(err, ErrAlreadyExists) {
+			t.Errorf("CreateUser with taken email: err = %v, want ErrAlreadyExists", err)
+		}
+
+		email, handle := "bob@example.com", "bob"
+		_, err = db.UpdateUser(user.ID, UserUpdate{Email: &email, Handle: &handle})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db = reopen()
+		got, err := db.GetUserByEmail("BOB@example.com")
+		if err != nil || got.ID != user.ID {
+			t.Errorf("GetUserByEmail after update = %+v, %v", got, err)
+		}
+		_, err = db.GetUserByEmail("alice@example.com")
+		if !errors.Is(err, ErrNotExist) {
+			t.Errorf("GetUserByEmail with old email: err = %v, want ErrNotExist", err)
+		}
+		got, err = db.GetUserByHandle("BOB")
+		if err != nil || got.ID != user.ID {
+			t.Errorf("GetUserByHandle = %+v, %v", got, err)
+		}
+		_, err = db.GetUser(42)
+		if !errors.Is(err, ErrNotExist) {
+			t.Errorf("GetUser(42): err = %v, want ErrNotExist", err)
+		}
+	})
+}
+
+func TestStoreChirps(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, db *DB, reopen func() *DB) {
+		first, err := db.CreateChirp("first", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.CreateChirp("second", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.DeleteChirp(first.ID, 2)
+		if !errors.Is(err, ErrNotExist) {
+			t.Errorf("DeleteChirp by someone else: err = %v, want ErrNotExist", err)
+		}
+		_, err = db.DeleteChirp(first.ID, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db = reopen()
+		_, err = db.GetChirpByID(first.ID)
+		if !errors.Is(err, ErrNotExist) {
+			t.Errorf("GetChirpByID of deleted chirp: err = %v, want ErrNotExist", err)
+		}
+		chirps, err := db.GetChirpsByAuthor(1)
+		if err != nil || len(chirps) != 0 {
+			t.Errorf("GetChirpsByAuthor(1) = %v, %v; want none", chirps, err)
+		}
+		chirps, err = db.GetDeletedChirpsByAuthor(1)
+		if err != nil || len(chirps) != 1 || chirps[0].ID != first.ID {
+			t.Errorf("GetDeletedChirpsByAuthor(1) = %v, %v; want the deleted chirp", chirps, err)
+		}
+		restored, err := db.RestoreChirp(first.ID)
+		if err != nil || restored.DeletedAt != nil {
+			t.Errorf("RestoreChirp = %+v, %v", restored, err)
+		}
+		chirps, err = db.GetChirps()
+		if err != nil || len(chirps) != 2 {
+			t.Errorf("GetChirps = %v, %v; want 2 chirps", chirps, err)
+		}
+
+		_, err = db.DeleteChirp(first.ID, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := db.PurgeDeletedChirps(time.Now().Add(time.Minute))
+		if err != nil || n != 1 {
+			t.Errorf("PurgeDeletedChirps = %d, %v; want 1", n, err)
+		}
+		third, err := db.CreateChirp("third", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if third.ID != 3 {
+			t.Errorf("chirp created after a purge got ID %d, want 3", third.ID)
+		}
+	})
+}
+
+func TestStoreSessions(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, db *DB, reopen func() *DB) {
+		user, err := db.CreateUser("alice@example.com", "hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expiresAt := time.Now().Add(time.Hour)
+		session, err := db.CreateSession(Session{UserID: user.ID, DeviceLabel: "laptop"}, "token-1", expiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.CreateSession(Session{UserID: 42}, "token-x", expiresAt)
+		if !errors.Is(err, ErrNotExist) {
+			t.Errorf("CreateSession for missing user: err = %v, want ErrNotExist", err)
+		}
+		_, err = db.RotateRefreshToken("token-1", "token-2", expiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db = reopen()
+		_, err = db.RotateRefreshToken("token-1", "token-3", expiresAt)
+		if !errors.Is(err, ErrTokenReused) {
+			t.Errorf("rotating a spent token: err = %v, want ErrTokenReused", err)
+		}
+		got, err := db.GetSession(session.ID)
+		if err != nil || got.RevokedAt == nil {
+			t.Errorf("session after token reuse = %+v, %v; want revoked", got, err)
+		}
+		_, err = db.RotateRefreshToken("token-2", "token-4", expiresAt)
+		if !errors.Is(err, ErrRevoked) {
+			t.Errorf("rotating in a revoked session: err = %v, want ErrRevoked", err)
+		}
+	})
+}
+
+func TestStoreSessionPurge(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, db *DB, reopen func() *DB) {
+		user, err := db.CreateUser("alice@example.com", "hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		live, err := db.CreateSession(Session{UserID: user.ID}, "live-1", time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.RotateRefreshToken("live-1", "live-2", time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expired, err := db.CreateSession(Session{UserID: user.ID}, "expired", time.Now().Add(-time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		revoked, err := db.CreateSession(Session{UserID: user.ID}, "revoked", time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.RevokeSession(revoked.ID, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sessions, err := db.ListSessions(user.ID)
+		if err != nil || len(sessions) != 1 || sessions[0].ID != live.ID {
+			t.Errorf("ListSessions = %+v, %v; want only session %d", sessions, err, live.ID)
+		}
+		n, err := db.PurgeExpiredSessions(time.Now())
+		if err != nil || n != 2 {
+			t.Errorf("PurgeExpiredSessions = %d, %v; want 2", n, err)
+		}
+
+		db = reopen()
+		for _, id := range []int{expired.ID, revoked.ID} {
+			_, err = db.GetSession(id)
+			if !errors.Is(err, ErrNotExist) {
+				t.Errorf("GetSession(%d) after the purge: err = %v, want ErrNotExist", id, err)
+			}
+		}
+		_, _, err = db.GetSessionByToken("expired")
+		if !errors.Is(err, ErrNotExist) {
+			t.Errorf("token of a purged session: err = %v, want ErrNotExist", err)
+		}
+		_, err = db.RotateRefreshToken("live-1", "live-3", time.Now().Add(time.Hour))
+		if !errors.Is(err, ErrTokenReused) {
+			t.Errorf("reusing a spent token after the purge: err = %v, want ErrTokenReused", err)
+		}
+	})
+}
+
+func TestStoreRollback(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, db *DB, reopen func() *DB) {
+		errFail := errors.New("fail")
+		err := db.Update(func(tx *Tx) error {
+			tx.putChirp(Chirp{ID: tx.nextID(tableChirps), Body: "lost", AuthorID: 1})
+			return errFail
+		})
+		if !errors.Is(err, errFail) {
+			t.Fatalf("Update: err = %v, want errFail", err)
+		}
+
+		db = reopen()
+		chirps, err := db.GetChirpsByAuthor(1)
+		if err != nil || len(chirps) != 0 {
+			t.Errorf("chirps after a failed Update = %v, %v; want none", chirps, err)
+		}
+		chirp, err := db.CreateChirp("kept", 1)
+		if err != nil || chirp.ID != 1 {
+			t.Errorf("CreateChirp after a failed Update = %+v, %v; want ID 1", chirp, err)
+		}
+	})
+}
+
+func TestStoreLocked(t *testing.T) {
+	for _, e := range engines {
+		if !e.persistent {
+			continue
+		}
+		t.Run(e.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database.json")
+			db := openTestDB(t, e.open, path)
+			_, err := e.open(path)
+			if !errors.Is(err, ErrLocked) {
+				t.Errorf("opening a database in use: err = %v, want ErrLocked", err)
+			}
+			err = db.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			db = openTestDB(t, e.open, path)
+			db.Close()
+		})
+	}
+}
+
+// A database in use can still be read, which is how backups and exports run
+// next to the server.
+func TestStoreReadOnly(t *testing.T) {
+	for _, e := range engines {
+		if !e.persistent {
+			continue
+		}
+		t.Run(e.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database.json")
+			db := openTestDB(t, e.open, path)
+			defer db.Close()
+			chirp, err := db.CreateChirp("logged", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			readOnly, err := e.openReadOnly(path)
+			if err != nil {
+				t.Fatalf("opening a database in use read-only: %v", err)
+			}
+			defer readOnly.Close()
+			_, err = readOnly.GetChirpByID(chirp.ID)
+			if err != nil {
+				t.Errorf("GetChirpByID(%d) on the read-only copy: %v", chirp.ID, err)
+			}
+			_, err = readOnly.CreateChirp("refused", 1)
+			if !errors.Is(err, ErrReadOnly) {
+				t.Errorf("CreateChirp on the read-only copy: err = %v, want ErrReadOnly", err)
+			}
+		})
+	}
+}
+
+func TestStorePasswordChange(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, db *DB, reopen func() *DB) {
+		user, err := db.CreateUser("alice@example.com", "hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expiresAt := time.Now().Add(time.Hour)
+		current, err := db.CreateSession(Session{UserID: user.ID}, "token-1", expiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := db.CreateSession(Session{UserID: user.ID}, "token-2", expiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash := "new hash"
+		_, err = db.UpdateUser(user.ID, UserUpdate{Password: &hash, KeepSessionID: current.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db = reopen()
+		got, err := db.GetSession(current.ID)
+		if err != nil || got.RevokedAt != nil {
+			t.Errorf("session changing the password = %+v, %v; want it kept", got, err)
+		}
+		got, err = db.GetSession(other.ID)
+		if err != nil || got.RevokedAt == nil {
+			t.Errorf("other session = %+v, %v; want it revoked", got, err)
+		}
+	})
+}
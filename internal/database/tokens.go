@@ -0,0 +1,92 @@
+package database
+
+import (
+	"strings"
+	"time"
+)
+
+// UsedToken records that the single-use token with this ID was spent. It
+// only has to outlive the token itself.
+type UsedToken struct {
+	ID        string    `json:"id"`
+	UserID    int       `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// useToken spends a single-use token, failing with ErrAlreadyUsed the second
+// time.
+func (tx *Tx) useToken(token UsedToken) error {
+	if _, ok := tx.UsedTokens[token.ID]; ok {
+		return ErrAlreadyUsed
+	}
+	tx.putUsedToken(token)
+	return nil
+}
+
+// ResetPassword spends a password reset token issued for email, sets the new
+// password and revokes every session of the user, all or nothing.
+func (db *DB) ResetPassword(token UsedToken, email string, hashedPassword string) (User, error) {
+	user := User{}
+	err := db.Update(func(tx *Tx) error {
+		v, ok := tx.Users[token.UserID]
+		if !ok || !strings.EqualFold(v.Email, email) {
+			return ErrNotExist
+		}
+		err := tx.useToken(token)
+		if err != nil {
+			return err
+		}
+		v.Password = hashedPassword
+		tx.putUser(v)
+		tx.revokeUserSessions(v.ID, 0)
+		user = v
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// VerifyEmail spends an email verification token issued for email. It fails
+// with ErrNotExist if the user has changed their email since.
+func (db *DB) VerifyEmail(token UsedToken, email string) (User, error) {
+	user := User{}
+	err := db.Update(func(tx *Tx) error {
+		v, ok := tx.Users[token.UserID]
+		if !ok || !strings.EqualFold(v.Email, email) {
+			return ErrNotExist
+		}
+		err := tx.useToken(token)
+		if err != nil {
+			return err
+		}
+		v.EmailVerified = true
+		tx.putUser(v)
+		user = v
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// PurgeUsedTokens forgets spent tokens that expired before the given time;
+// they would be refused as expired anyway.
+func (db *DB) PurgeUsedTokens(before time.Time) (int, error) {
+	purged := 0
+	err := db.Update(func(tx *Tx) error {
+		for id, token := range tx.UsedTokens {
+			if token.ExpiresAt.Before(before) {
+				tx.deleteUsedToken(id)
+				purged++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
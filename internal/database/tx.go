@@ -0,0 +1,168 @@
+package database
+
+import "fmt"
+
+// Tx is the database state as seen inside View or Update. Inside Update,
+// writes must go through the put and delete helpers: they keep the index
+// current, tell the engine what to persist, and know how to undo themselves.
+type Tx struct {
+	*DBStructure
+	idx     *index
+	changes []change
+	undo    []func()
+}
+
+// change names a row written by a transaction. Engines read the row's final
+// value, or its absence, from the committed state.
+type change struct {
+	table string
+	key   string
+}
+
+func (tx *Tx) record(table string, key string, undo func()) {
+	tx.changes = append(tx.changes, change{table: table, key: key})
+	tx.undo = append(tx.undo, undo)
+}
+
+// rollback reverts every recorded write, newest first, and reports whether
+// there was anything to revert.
+func (tx *Tx) rollback() bool {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	return len(tx.undo) > 0
+}
+
+func putRow[K comparable, V any](tx *Tx, table string, rows map[K]V, key K, value V) {
+	old, had := rows[key]
+	tx.record(table, fmt.Sprint(key), func() {
+		if had {
+			rows[key] = old
+		} else {
+			delete(rows, key)
+		}
+	})
+	rows[key] = value
+}
+
+func deleteRow[K comparable, V any](tx *Tx, table string, rows map[K]V, key K) {
+	old, had := rows[key]
+	if !had {
+		return
+	}
+	tx.record(table, fmt.Sprint(key), func() {
+		rows[key] = old
+	})
+	delete(rows, key)
+}
+
+func (tx *Tx) setSchemaVersion(version int) {
+	old := tx.SchemaVersion
+	tx.record(fieldSchemaVersion, "", func() {
+		tx.SchemaVersion = old
+	})
+	tx.SchemaVersion = version
+}
+
+func (tx *Tx) putSequence(table string, id int) {
+	putRow(tx, tableSequences, tx.Sequences, table, id)
+}
+
+// nextID reserves the next ID for table.
+func (tx *Tx) nextID(table string) int {
+	id := tx.Sequences[table] + 1
+	tx.putSequence(table, id)
+	return id
+}
+
+func (tx *Tx) putUser(user User) {
+	if old, ok := tx.Users[user.ID]; ok {
+		tx.idx.removeUser(old)
+	}
+	putRow(tx, tableUsers, tx.Users, user.ID, user)
+	tx.idx.addUser(user)
+}
+
+func (tx *Tx) deleteUser(id int) {
+	if old, ok := tx.Users[id]; ok {
+		tx.idx.removeUser(old)
+	}
+	deleteRow(tx, tableUsers, tx.Users, id)
+}
+
+func (tx *Tx) putChirp(chirp Chirp) {
+	if old, ok := tx.Chirps[chirp.ID]; ok {
+		tx.idx.removeChirp(old)
+	}
+	putRow(tx, tableChirps, tx.Chirps, chirp.ID, chirp)
+	tx.idx.addChirp(chirp)
+}
+
+func (tx *Tx) deleteChirp(id int) {
+	if old, ok := tx.Chirps[id]; ok {
+		tx.idx.removeChirp(old)
+	}
+	deleteRow(tx, tableChirps, tx.Chirps, id)
+}
+
+func (tx *Tx) putSession(session Session) {
+	putRow(tx, tableSessions, tx.Sessions, session.ID, session)
+}
+
+// deleteSession deletes a session together with its refresh tokens.
+func (tx *Tx) deleteSession(id int) {
+	for hash, v := range tx.RefreshTokens {
+		if v.SessionID == id {
+			tx.deleteRefreshToken(hash)
+		}
+	}
+	deleteRow(tx, tableSessions, tx.Sessions, id)
+}
+
+func (tx *Tx) putRefreshToken(token RefreshToken) {
+	putRow(tx, tableRefreshTokens, tx.RefreshTokens, token.Hash, token)
+}
+
+func (tx *Tx) deleteRefreshToken(hash string) {
+	deleteRow(tx, tableRefreshTokens, tx.RefreshTokens, hash)
+}
+
+func (tx *Tx) putUsedToken(token UsedToken) {
+	putRow(tx, tableUsedTokens, tx.UsedTokens, token.ID, token)
+}
+
+func (tx *Tx) deleteUsedToken(id string) {
+	deleteRow(tx, tableUsedTokens, tx.UsedTokens, id)
+}
+
+func (tx *Tx) putOAuthClient(client OAuthClient) {
+	putRow(tx, tableOAuthClients, tx.OAuthClients, client.ID, client)
+}
+
+func (tx *Tx) deleteOAuthClient(id string) {
+	deleteRow(tx, tableOAuthClients, tx.OAuthClients, id)
+}
+
+func (tx *Tx) putAuthCode(code AuthCode) {
+	putRow(tx, tableAuthCodes, tx.AuthCodes, code.Hash, code)
+}
+
+func (tx *Tx) deleteAuthCode(hash string) {
+	deleteRow(tx, tableAuthCodes, tx.AuthCodes, hash)
+}
+
+func (tx *Tx) putIdentity(identity Identity) {
+	putRow(tx, tableIdentities, tx.Identities, identityKey(identity.Issuer, identity.Subject), identity)
+}
+
+func (tx *Tx) deleteIdentity(key string) {
+	deleteRow(tx, tableIdentities, tx.Identities, key)
+}
+
+func (tx *Tx) putAPIKey(key APIKey) {
+	putRow(tx, tableAPIKeys, tx.APIKeys, key.Hash, key)
+}
+
+func (tx *Tx) deleteAPIKey(hash string) {
+	deleteRow(tx, tableAPIKeys, tx.APIKeys, hash)
+}
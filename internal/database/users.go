@@ -2,41 +2,66 @@ package database
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 )
 
-type RevokeToken struct {
-	ID   string `json:"id"`
-	Time string `json:"time"`
-}
-
 type User struct {
-	ID          int         `json:"id"`
-	Email       string      `json:"email"`
-	Password    string      `json:"password"`
-	RevokeToken RevokeToken `json:"revoke_token"`
-	IsChirpyRed bool        `json:"is_chirpy_red"`
+	ID          int    `json:"id"`
+	Email       string `json:"email"`
+	Password    string `json:"password"`
+	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Role        string `json:"role"`
+	// EmailVerified is cleared whenever Email changes.
+	EmailVerified bool `json:"email_verified"`
+	// TOTPSecret is set on enrolment and only used for login once
+	// TOTPEnabled is set by a confirmed code.
+	TOTPSecret    string   `json:"totp_secret,omitempty"`
+	TOTPEnabled   bool     `json:"totp_enabled"`
+	TOTPLastStep  int64    `json:"totp_last_step,omitempty"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+	// Handle is the public name of the user, unique regardless of case.
+	// Unlike Email, it and the rest of the profile are public.
+	Handle      string `json:"handle,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	Bio         string `json:"bio,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+	// DeletedAt is set on the anonymised remains of a deleted account,
+	// kept so its chirps still have an author.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
-var ErrAlreadyExists = errors.New("user already exist")
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+var (
+	ErrAlreadyExists = errors.New("user already exist")
+	ErrInvalidRole   = errors.New("invalid role")
+	ErrHandleTaken   = errors.New("handle taken")
+)
 
 func (db *DB) CreateUser(email string, hashedPassword string) (User, error) {
-	if _, err := db.GetUserByEmail(email); !errors.Is(err, ErrNotExist) {
-		return User{}, ErrAlreadyExists
-	}
-	dbStruct, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
-	id := len(dbStruct.Users) + 1
-	user := User{
-		ID:          id,
-		Email:       email,
-		Password:    hashedPassword,
-		IsChirpyRed: false,
-	}
-	dbStruct.Users[id] = user
-	err = db.writeDB(dbStruct)
+	user := User{}
+	err := db.Update(func(tx *Tx) error {
+		if _, ok := tx.userByEmail(email); ok {
+			return ErrAlreadyExists
+		}
+		id := tx.nextID(tableUsers)
+		user = User{
+			ID:          id,
+			Email:       email,
+			Password:    hashedPassword,
+			IsChirpyRed: false,
+			Role:        RoleUser,
+			Handle:      tx.defaultHandle(id),
+		}
+		tx.putUser(user)
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
@@ -44,91 +69,223 @@ func (db *DB) CreateUser(email string, hashedPassword string) (User, error) {
 }
 
 func (db *DB) GetUser(id int) (User, error) {
-	dbStructure, err := db.loadDB()
+	user := User{}
+	err := db.View(func(tx *Tx) error {
+		v, ok := tx.Users[id]
+		if !ok {
+			return ErrNotExist
+		}
+		user = v
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
-
-	user, ok := dbStructure.Users[id]
-	if !ok {
-		return User{}, ErrNotExist
-	}
-
 	return user, nil
 }
 
 func (db *DB) GetUserByEmail(email string) (User, error) {
-	dbStructure, err := db.loadDB()
+	user := User{}
+	err := db.View(func(tx *Tx) error {
+		v, ok := tx.userByEmail(email)
+		if !ok {
+			return ErrNotExist
+		}
+		user = v
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
+	return user, nil
+}
 
-	for _, user := range dbStructure.Users {
-		if user.Email == email {
-			return user, nil
-		}
-	}
-
-	return User{}, ErrNotExist
+// UserUpdate lists the fields UpdateUser changes; nil ones are left alone.
+// Password is the new hash.
+type UserUpdate struct {
+	Email       *string
+	Password    *string
+	Handle      *string
+	DisplayName *string
+	Bio         *string
+	AvatarURL   *string
+	// KeepSessionID is the session changing the password, the only one
+	// left unrevoked when Password is set.
+	KeepSessionID int
 }
 
-func (db *DB) UpdateUser(id int, email string, password string) (User, error) {
-	dbStruct, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
-	updatedUser := User{
-		ID:       id,
-		Email:    email,
-		Password: password,
-	}
-	dbStruct.Users[id] = updatedUser
-	err = db.writeDB(dbStruct)
+func (db *DB) UpdateUser(id int, update UserUpdate) (User, error) {
+	updatedUser := User{}
+	err := db.Update(func(tx *Tx) error {
+		user, ok := tx.Users[id]
+		if !ok || user.DeletedAt != nil {
+			return ErrNotExist
+		}
+		if update.Email != nil {
+			if other, ok := tx.userByEmail(*update.Email); ok && other.ID != id {
+				return ErrAlreadyExists
+			}
+			if !strings.EqualFold(user.Email, *update.Email) {
+				user.EmailVerified = false
+			}
+			user.Email = *update.Email
+		}
+		if update.Password != nil {
+			user.Password = *update.Password
+			tx.revokeUserSessions(id, update.KeepSessionID)
+		}
+		if update.Handle != nil {
+			if other, ok := tx.userByHandle(*update.Handle); ok && other.ID != id {
+				return ErrHandleTaken
+			}
+			user.Handle = *update.Handle
+		}
+		if update.DisplayName != nil {
+			user.DisplayName = *update.DisplayName
+		}
+		if update.Bio != nil {
+			user.Bio = *update.Bio
+		}
+		if update.AvatarURL != nil {
+			user.AvatarURL = *update.AvatarURL
+		}
+		tx.putUser(user)
+		updatedUser = user
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
-
 	return updatedUser, nil
 }
 
-func (db *DB) CreateRevokeToken(id int, time time.Time, tokenID string) (User, error) {
-	dbStruct, err := db.loadDB()
+func (db *DB) GetUserByHandle(handle string) (User, error) {
+	user := User{}
+	err := db.View(func(tx *Tx) error {
+		v, ok := tx.userByHandle(handle)
+		if !ok {
+			return ErrNotExist
+		}
+		user = v
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
-	user, err := db.GetUser(id)
-	if err != nil {
-		return User{}, ErrNotExist
-	}
+	return user, nil
+}
 
-	user.RevokeToken = RevokeToken{
-		ID:   tokenID,
-		Time: time.UTC().String(),
-	}
-	dbStruct.Users[id] = user
-	err = db.writeDB(dbStruct)
-	if err != nil {
-		return User{}, err
+// defaultHandle is the handle a user starts with, until they pick one.
+func (tx *Tx) defaultHandle(id int) string {
+	handle := fmt.Sprintf("user%d", id)
+	for n := 2; ; n++ {
+		if _, taken := tx.userByHandle(handle); !taken {
+			return handle
+		}
+		handle = fmt.Sprintf("user%d_%d", id, n)
 	}
-
-	return user, nil
 }
 
 func (db *DB) UpdateWebhook(id int) (User, error) {
-	dbStruct, err := db.loadDB()
+	user := User{}
+	err := db.Update(func(tx *Tx) error {
+		v, ok := tx.Users[id]
+		if !ok || v.DeletedAt != nil {
+			return ErrNotExist
+		}
+		v.IsChirpyRed = true
+		tx.putUser(v)
+		user = v
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
-	user, err := db.GetUser(id)
-	if err != nil {
-		return User{}, ErrNotExist
-	}
-	user.IsChirpyRed = true
-	dbStruct.Users[id] = user
-	err = db.writeDB(dbStruct)
-	if err != nil {
-		return User{}, err
+	return user, nil
+}
+
+// UpgradePasswordHash replaces the user's password hash with newHash, an
+// equivalent one with better parameters, unless the password changed since
+// oldHash was read.
+func (db *DB) UpgradePasswordHash(id int, oldHash string, newHash string) error {
+	_, err := db.updateUser(id, func(user *User) error {
+		if user.Password != oldHash {
+			return ErrNotExist
+		}
+		user.Password = newHash
+		return nil
+	})
+	return err
+}
+
+func (db *DB) SetUserRole(id int, role string) (User, error) {
+	switch role {
+	case RoleUser, RoleModerator, RoleAdmin:
+	default:
+		return User{}, ErrInvalidRole
 	}
+	return db.updateUser(id, func(user *User) error {
+		user.Role = role
+		return nil
+	})
+}
 
-	return user, nil
+// DeleteUser deletes the user's account along with every credential,
+// session, identity, API key, OAuth client and single-use token of it. The
+// chirps go too, unless anonymize is set: then they stay, and the user is
+// kept as a DeletedAt tombstone with no personal data left.
+func (db *DB) DeleteUser(id int, anonymize bool) error {
+	return db.Update(func(tx *Tx) error {
+		user, ok := tx.Users[id]
+		if !ok || user.DeletedAt != nil {
+			return ErrNotExist
+		}
+		for _, v := range tx.Sessions {
+			if v.UserID == id {
+				tx.deleteSession(v.ID)
+			}
+		}
+		for hash, v := range tx.AuthCodes {
+			if v.UserID == id {
+				tx.deleteAuthCode(hash)
+			}
+		}
+		for _, v := range tx.OAuthClients {
+			if v.OwnerID == id {
+				tx.removeOAuthClient(v.ID)
+			}
+		}
+		for key, v := range tx.Identities {
+			if v.UserID == id {
+				tx.deleteIdentity(key)
+			}
+		}
+		for hash, v := range tx.APIKeys {
+			if v.UserID == id {
+				tx.deleteAPIKey(hash)
+			}
+		}
+		for key, v := range tx.UsedTokens {
+			if v.UserID == id {
+				tx.deleteUsedToken(key)
+			}
+		}
+
+		if anonymize {
+			now := time.Now().UTC()
+			tx.putUser(User{
+				ID:        id,
+				Role:      RoleUser,
+				DeletedAt: &now,
+			})
+			return nil
+		}
+		for _, v := range tx.Chirps {
+			if v.AuthorID == id {
+				tx.deleteChirp(v.ID)
+			}
+		}
+		tx.deleteUser(id)
+		return nil
+	})
 }
@@ -0,0 +1,397 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+)
+
+// walCompactThreshold is the number of log records after which the log is
+// folded into a fresh snapshot and truncated.
+const walCompactThreshold = 1000
+
+const (
+	walPut    = "put"
+	walDelete = "delete"
+)
+
+type walRecord struct {
+	Op    string `json:"op"`
+	Table string `json:"table"`
+	// ID is only read, from logs written before rows were keyed by Key.
+	ID    int             `json:"id,omitempty"`
+	Key   string          `json:"key,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// walEngine appends one record per changed row to <path>.wal, so a write
+// costs the size of the change rather than the size of the database. The
+// snapshot at <path> has the same layout as the file engine uses.
+type walEngine struct {
+	path    string
+	lock    *os.File
+	log     *os.File
+	offset  int64
+	entries int
+	fresh   bool
+	// torn is set when a failed append could not be cut off again. The log
+	// may then end in records of a rolled back write, so the next write
+	// replaces it with a snapshot instead of appending.
+	torn bool
+	// state is the snapshot plus the replayed log, held only until the DB
+	// takes it over in load.
+	state *DBStructure
+	// readOnly engines only read the snapshot and log, see readWAL.
+	readOnly bool
+}
+
+// NewWALDB opens the database at path with its log. Like NewDB, it holds an
+// exclusive lock on <path>.lock until Close.
+func NewWALDB(path string, opts ...Option) (*DB, error) {
+	e, err := openWALEngine(path)
+	if err != nil {
+		return &DB{}, err
+	}
+	db, err := newDB(e, newOptions(opts))
+	if err != nil {
+		e.close()
+		return &DB{}, err
+	}
+	return db, nil
+}
+
+func openWALEngine(path string) (*walEngine, error) {
+	lock, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	e := &walEngine{path: path, lock: lock}
+	err = e.open()
+	if err != nil {
+		e.close()
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *walEngine) open() error {
+	data, err := os.ReadFile(e.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		e.fresh = true
+		e.state = &DBStructure{}
+		initTables(e.state)
+	case err != nil:
+		return err
+	default:
+		dbStructure, err := decodeDB(data)
+		if err != nil {
+			return err
+		}
+		err = checkSchemaVersion(dbStructure.SchemaVersion)
+		if err != nil {
+			return err
+		}
+		e.state = &dbStructure
+	}
+
+	if e.log == nil {
+		e.log, err = os.OpenFile(e.path+".wal", os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	err = e.checkLogSchema()
+	if err != nil {
+		return err
+	}
+	return e.replay()
+}
+
+// checkLogSchema refuses a log written by a newer build before replay meets
+// records it does not understand. A migration logs its new schema version
+// after the rows it changed, so the whole log has to be looked at first.
+func (e *walEngine) checkLogSchema() error {
+	reader := bufio.NewReader(e.log)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		record := walRecord{}
+		if json.Unmarshal(line, &record) != nil || record.Table != fieldSchemaVersion {
+			continue
+		}
+		version := 0
+		if json.Unmarshal(record.Value, &version) != nil {
+			continue
+		}
+		err = checkSchemaVersion(version)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := e.log.Seek(0, io.SeekStart)
+	return err
+}
+
+// replay applies every record in the log. A last line without its newline,
+// which is what a crash in the middle of an append leaves behind, is cut
+// off. A complete record that cannot be applied is an error: cutting the log
+// there would throw away every record after it.
+func (e *walEngine) replay() error {
+	reader := bufio.NewReader(e.log)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		record := walRecord{}
+		err = json.Unmarshal(line, &record)
+		if err == nil {
+			err = applyWALRecord(e.state, record)
+		}
+		if err != nil {
+			return fmt.Errorf("%s.wal: record at offset %d: %w", e.path, e.offset, err)
+		}
+		e.offset += int64(len(line))
+		e.entries++
+		e.fresh = false
+	}
+	if e.readOnly {
+		return nil
+	}
+	return e.truncate(e.offset)
+}
+
+// readWAL reads the snapshot and log at path as they are now, without the
+// lock NewWALDB takes. A shared lock on the log keeps a server that has the
+// database open from appending or compacting in between.
+func readWAL(path string) (DBStructure, error) {
+	e := &walEngine{path: path, readOnly: true}
+	var err error
+	e.log, err = os.Open(path + ".wal")
+	if errors.Is(err, os.ErrNotExist) {
+		return readDBFile(path)
+	}
+	if err != nil {
+		return DBStructure{}, err
+	}
+	defer e.log.Close()
+	err = lockShared(e.log)
+	if err != nil {
+		return DBStructure{}, err
+	}
+	defer unlock(e.log)
+	err = e.open()
+	if err != nil {
+		return DBStructure{}, err
+	}
+	return *e.state, nil
+}
+
+func (e *walEngine) truncate(offset int64) error {
+	err := e.log.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	_, err = e.log.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	e.offset = offset
+	return nil
+}
+
+func (e *walEngine) load() (DBStructure, error) {
+	if e.fresh || e.state == nil {
+		return DBStructure{}, os.ErrNotExist
+	}
+	dbStructure := *e.state
+	e.state = nil
+	return dbStructure, nil
+}
+
+func (e *walEngine) write(dbStructure *DBStructure, changes []change) error {
+	err := lockExclusive(e.log)
+	if err != nil {
+		return err
+	}
+	defer unlock(e.log)
+
+	buf := bytes.Buffer{}
+	seen := map[change]bool{}
+	records := 0
+	for _, c := range changes {
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+		record, err := walRecordFor(dbStructure, c)
+		if err != nil {
+			return err
+		}
+		dat, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		buf.Write(dat)
+		buf.WriteByte('\n')
+		records++
+	}
+
+	if e.torn {
+		return e.compact(dbStructure)
+	}
+	if buf.Len() > 0 {
+		_, err := e.log.Write(buf.Bytes())
+		if err == nil {
+			err = e.log.Sync()
+		}
+		if err != nil {
+			// Drop whatever part of the batch made it to disk so the
+			// next append does not land behind a torn record.
+			truncateErr := e.truncate(e.offset)
+			if truncateErr != nil {
+				e.torn = true
+				return errors.Join(err, truncateErr)
+			}
+			return err
+		}
+		e.offset += int64(buf.Len())
+		e.entries += records
+	}
+
+	if changes == nil {
+		return e.compact(dbStructure)
+	}
+	if e.fresh || e.entries >= walCompactThreshold {
+		// The records are durable, so the write stands whether or not
+		// the log could be folded away; the next write tries again.
+		err := e.compact(dbStructure)
+		if err != nil {
+			log.Printf("database: compacting %s.wal: %v", e.path, err)
+		}
+	}
+	return nil
+}
+
+// stale is always false: the lock keeps other processes from writing.
+func (e *walEngine) stale() bool {
+	return false
+}
+
+func (e *walEngine) close() error {
+	var err error
+	if e.log != nil {
+		err = e.log.Close()
+	}
+	return errors.Join(err, e.lock.Close())
+}
+
+// compact writes the state as the new snapshot and empties the log. The
+// snapshot is in place before the log is truncated, so a crash in between
+// only means some records are replayed on top of a state that already
+// contains them.
+func (e *walEngine) compact(dbStructure *DBStructure) error {
+	dat, err := json.MarshalIndent(dbStructure, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(e.path, dat, 0600)
+	if err != nil {
+		return err
+	}
+	err = e.truncate(0)
+	if err != nil {
+		return err
+	}
+	e.fresh = false
+	e.torn = false
+	e.entries = 0
+	return nil
+}
+
+// walRecordFor builds the record for a changed row from its committed value:
+// a put if the row exists, a delete if it does not.
+func walRecordFor(dbStructure *DBStructure, c change) (walRecord, error) {
+	field, err := tableField(dbStructure, c.table)
+	if err != nil {
+		return walRecord{}, err
+	}
+	if field.Kind() != reflect.Map {
+		dat, err := json.Marshal(field.Interface())
+		return walRecord{Op: walPut, Table: c.table, Value: dat}, err
+	}
+
+	key, err := walKey(field.Type().Key(), c.key)
+	if err != nil {
+		return walRecord{}, err
+	}
+	row := field.MapIndex(key)
+	if !row.IsValid() {
+		return walRecord{Op: walDelete, Table: c.table, Key: c.key}, nil
+	}
+	dat, err := json.Marshal(row.Interface())
+	return walRecord{Op: walPut, Table: c.table, Key: c.key, Value: dat}, err
+}
+
+func applyWALRecord(dbStructure *DBStructure, record walRecord) error {
+	field, err := tableField(dbStructure, record.Table)
+	if err != nil {
+		return err
+	}
+	if field.Kind() != reflect.Map {
+		return json.Unmarshal(record.Value, field.Addr().Interface())
+	}
+
+	rawKey := record.Key
+	if rawKey == "" {
+		rawKey = strconv.Itoa(record.ID)
+	}
+	key, err := walKey(field.Type().Key(), rawKey)
+	if err != nil {
+		return err
+	}
+	if record.Op == walDelete {
+		field.SetMapIndex(key, reflect.Value{})
+		return nil
+	}
+	row := reflect.New(field.Type().Elem())
+	err = json.Unmarshal(record.Value, row.Interface())
+	if err != nil {
+		return err
+	}
+	field.SetMapIndex(key, row.Elem())
+	return nil
+}
+
+func walKey(t reflect.Type, raw string) (reflect.Value, error) {
+	key := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.String:
+		key.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		key.SetInt(n)
+	default:
+		return reflect.Value{}, fmt.Errorf("unsupported wal key type %s", t)
+	}
+	return key, nil
+}
@@ -0,0 +1,110 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A write whose records reached the log stands even when the compaction
+// after it fails.
+func TestWALCompactionFailureKeepsWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewWALDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := db.engine.(*walEngine)
+	e.entries = walCompactThreshold - 1
+	e.path = filepath.Join(t.TempDir(), "missing", "database.json")
+
+	chirp, err := db.CreateChirp("kept", 1)
+	if err != nil {
+		t.Fatalf("CreateChirp with failing compaction: %v", err)
+	}
+	_, err = db.GetChirpByID(chirp.ID)
+	if err != nil {
+		t.Errorf("GetChirpByID after failed compaction: %v", err)
+	}
+
+	db.Close()
+	db, err = NewWALDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.GetChirpByID(chirp.ID)
+	if err != nil {
+		t.Errorf("GetChirpByID after reopen: %v", err)
+	}
+}
+
+// A complete record that cannot be read is not a torn tail: opening fails and
+// the records after it stay in the log.
+func TestWALReplayBadRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewWALDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateChirp("first", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	good, err := os.ReadFile(path + ".wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	damaged := append(append(append([]byte{}, good...), "{garbled\n"...), good...)
+	err = os.WriteFile(path+".wal", damaged, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewWALDB(path)
+	if err == nil {
+		t.Fatal("opened a log with a garbled record in the middle")
+	}
+	after, err := os.ReadFile(path + ".wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(damaged) {
+		t.Errorf("log changed from %d to %d bytes by the failed open", len(damaged), len(after))
+	}
+}
+
+// A crash in the middle of an append leaves a last line without its newline,
+// which is cut off.
+func TestWALReplayTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewWALDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirp, err := db.CreateChirp("first", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	log, err := os.OpenFile(path+".wal", os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = log.WriteString(`{"op":"put","table":"chirps","key":"2","val`)
+	log.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewWALDB(path)
+	if err != nil {
+		t.Fatalf("opening a log with a torn tail: %v", err)
+	}
+	defer db.Close()
+	_, err = db.GetChirpByID(chirp.ID)
+	if err != nil {
+		t.Errorf("GetChirpByID(%d) before the torn tail: %v", chirp.ID, err)
+	}
+}
@@ -0,0 +1,36 @@
+package mailer
+
+import (
+	"os"
+	"sync"
+)
+
+// FileMailer appends every message to a file instead of sending it, so local
+// development and tests can read what would have gone out.
+type FileMailer struct {
+	path string
+	from string
+	mux  sync.Mutex
+}
+
+func NewFileMailer(path string, from string) *FileMailer {
+	return &FileMailer{
+		path: path,
+		from: from,
+	}
+}
+
+func (m *FileMailer) Send(msg Message) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	file, err := os.OpenFile(m.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(format(m.from, msg), '\n'))
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
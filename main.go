@@ -1,68 +1,410 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/joho/godotenv"
+	"github/ntvviktor/GoServer/internal/auth"
 	"github/ntvviktor/GoServer/internal/database"
+	"github/ntvviktor/GoServer/internal/mailer"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type apiConfig struct {
 	fileServerHits int
-	DB             *database.DB
-	jwtSecret      string
+	DB             database.Store
+	keys           *auth.KeyManager
 	apiKey         string
+	chirpRetention time.Duration
+	mailer         mailer.Mailer
+	// appURL is where links in emails point, without a trailing slash.
+	appURL         string
+	loginThrottle  *loginThrottle
+	passwordPolicy *auth.PasswordPolicy
+	hashParams     auth.HashParams
+	// oidc is the external login provider, nil unless OIDC_ISSUER is set.
+	oidc       *auth.OIDCProvider
+	oidcLogins *oidcLogins
+	// accountDeletion is what deleting an account does to its chirps.
+	accountDeletion string
+	dataExports     *dataExports
+	activity        *activity
 }
 
+// defaultChirpRetention is how long a deleted chirp stays restorable when
+// CHIRP_RETENTION is not set.
+const defaultChirpRetention = 30 * 24 * time.Hour
+
 func main() {
 	r := chi.NewRouter()
 	corsMux := MiddlewareCors(r)
-	db, err := database.NewDB("database.json")
+	_ = godotenv.Load("local.env")
+	if len(os.Args) > 1 {
+		err := runCommand(os.Args[1], os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	db, err := openDB(os.Getenv("DB_ENGINE"), "database.json")
 	if err != nil {
 		fmt.Println("Database gets error")
 		log.Fatal(err)
 	}
 
-	_ = godotenv.Load("local.env")
-	jwtSecret := os.Getenv("JWT_SECRET")
+	keys, err := loadKeys()
+	if err != nil {
+		log.Fatal(err)
+	}
 	apiKey := os.Getenv("API_KEY")
+	chirpRetention := defaultChirpRetention
+	if retention := os.Getenv("CHIRP_RETENTION"); retention != "" {
+		chirpRetention, err = time.ParseDuration(retention)
+		if err != nil {
+			log.Fatalf("invalid CHIRP_RETENTION: %v", err)
+		}
+	}
+	appURL := strings.TrimSuffix(os.Getenv("APP_URL"), "/")
+	if appURL == "" {
+		appURL = "http://localhost:8080/app"
+	}
+	mail, err := newMailer(appURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hashParams, err := loadHashParams()
+	if err != nil {
+		log.Fatal(err)
+	}
+	passwordPolicy, err := loadPasswordPolicy(hashParams)
+	if err != nil {
+		log.Fatal(err)
+	}
+	oidc, err := loadOIDCProvider()
+	if err != nil {
+		log.Fatal(err)
+	}
+	accountDeletion := os.Getenv("ACCOUNT_DELETION")
+	switch accountDeletion {
+	case "":
+		accountDeletion = deletionDelete
+	case deletionDelete, deletionAnonymize:
+	default:
+		log.Fatalf("invalid ACCOUNT_DELETION %q, want %s or %s", accountDeletion, deletionDelete, deletionAnonymize)
+	}
 	apiCfg := apiConfig{
-		fileServerHits: 0,
-		DB:             db,
-		jwtSecret:      jwtSecret,
-		apiKey:         apiKey,
+		fileServerHits:  0,
+		DB:              db,
+		keys:            keys,
+		apiKey:          apiKey,
+		chirpRetention:  chirpRetention,
+		mailer:          mail,
+		appURL:          appURL,
+		loginThrottle:   newLoginThrottle(),
+		passwordPolicy:  passwordPolicy,
+		hashParams:      hashParams,
+		oidc:            oidc,
+		oidcLogins:      newOIDCLogins(),
+		accountDeletion: accountDeletion,
+		dataExports:     newDataExports(),
+		activity:        newActivity(),
 	}
+	go runEvery(time.Hour, apiCfg.purgeDeletedChirps)
+	go runEvery(time.Hour, apiCfg.purgeExpiredSessions)
+	go runEvery(time.Hour, apiCfg.purgeUsedTokens)
+	go runEvery(time.Hour, apiCfg.purgeExpiredAuthCodes)
+	go runEvery(time.Hour, apiCfg.purgeExpiredAPIKeys)
+	go runEvery(time.Hour, apiCfg.loginThrottle.prune)
+	go runEvery(time.Hour, apiCfg.oidcLogins.prune)
+	go runEvery(time.Hour, apiCfg.dataExports.prune)
+	go runEvery(activityFlushInterval, apiCfg.flushActivity)
+	// Pick up rotations done with the keys subcommand without a restart.
+	go runEvery(time.Minute, func() {
+		err := keys.Reload()
+		if err != nil {
+			log.Printf("reloading signing keys: %v", err)
+		}
+	})
 	fsHandler := apiCfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir("."))))
 
 	// Split the /admin and /api router
 	adminRouter := chi.NewRouter()
-	adminRouter.Get("/metrics", apiCfg.metricNumber())
+	adminRouter.Use(apiCfg.middlewareAuth)
+	adminRouter.Group(func(r chi.Router) {
+		r.Use(requireRole(database.RoleModerator))
+		r.Delete("/chirps/{chirpID}", apiCfg.handleModerateChirp)
+	})
+	adminRouter.Group(func(r chi.Router) {
+		r.Use(requireRole(database.RoleAdmin))
+		r.Get("/metrics", apiCfg.metricNumber())
+		r.Post("/chirps/{chirpID}/restore", apiCfg.handleAdminRestoreChirp)
+		r.Post("/backup", apiCfg.handleBackup)
+		r.Post("/restore", apiCfg.handleRestore)
+		r.Post("/users/{userID}/unlock", apiCfg.handleUnlockUser)
+		r.Put("/users/{userID}/role", apiCfg.handleSetUserRole)
+	})
 
 	apiRouter := chi.NewRouter()
-	apiRouter.Handle("/reset", apiCfg.resetMetric())
+	apiRouter.With(apiCfg.middlewareAuth, requireRole(database.RoleAdmin)).Handle("/reset", apiCfg.resetMetric())
 	apiRouter.Get("/healthz", func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
 	apiRouter.Post("/users", apiCfg.createUser)
-	apiRouter.Put("/users", apiCfg.validateUser)
 	apiRouter.Post("/login", apiCfg.authenticateUser)
+	apiRouter.Post("/login/mfa", apiCfg.handleLoginMFA)
+	apiRouter.Post("/password-reset/request", apiCfg.handlePasswordResetRequest)
+	apiRouter.Post("/password-reset/confirm", apiCfg.handlePasswordResetConfirm)
+	apiRouter.Post("/users/verify", apiCfg.handleVerifyEmail)
 	apiRouter.Post("/refresh", apiCfg.postRefreshToken)
 	apiRouter.Post("/revoke", apiCfg.postRevokeToken)
-	apiRouter.Post("/chirps", apiCfg.handlePostChirps)
 	apiRouter.Post("/polka/webhooks", apiCfg.handleWebhook)
+	apiRouter.Get("/users/{handle}", apiCfg.handleGetProfile)
 	apiRouter.Get("/chirps", apiCfg.handleGetChirps)
 	apiRouter.Get("/chirps/{chirpID}", apiCfg.getChirpsById)
-	apiRouter.Delete("/chirps/{chirpID}", apiCfg.handleDeleteChirp)
+	if apiCfg.oidc != nil {
+		apiRouter.Get("/oidc/login", apiCfg.handleOIDCLogin)
+		apiRouter.Get("/oidc/callback", apiCfg.handleOIDCCallback)
+		apiRouter.With(apiCfg.middlewareAuth, requireScope(auth.ScopeAccount)).Post("/oidc/link", apiCfg.handleOIDCLink)
+	}
+
+	// Everything in here needs an access token or a personal API key; see
+	// middlewareAuth. Tokens granted to OAuth clients and API keys only reach
+	// the routes of their scopes.
+	apiRouter.Group(func(r chi.Router) {
+		r.Use(apiCfg.middlewareAuth)
+		r.With(requireScope(auth.ScopeProfile)).Get("/users/me", apiCfg.handleGetMe)
+		r.Group(func(r chi.Router) {
+			r.Use(requireScope(auth.ScopeChirpsWrite))
+			r.Post("/chirps", apiCfg.handlePostChirps)
+			r.Delete("/chirps/{chirpID}", apiCfg.handleDeleteChirp)
+			r.Post("/chirps/{chirpID}/restore", apiCfg.handleRestoreChirp)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(requireScope(auth.ScopeAccount))
+			r.Patch("/users/me", apiCfg.handleUpdateMe)
+			r.Delete("/users", apiCfg.handleDeleteUser)
+			r.Get("/users/me/export", apiCfg.handleExportUser)
+			r.Post("/users/verify/resend", apiCfg.handleResendVerification)
+			r.Get("/sessions", apiCfg.handleListSessions)
+			r.Delete("/sessions/{sessionID}", apiCfg.handleRevokeSession)
+			r.Post("/logout-all", apiCfg.handleLogoutAll)
+			r.Post("/mfa/totp/enroll", apiCfg.handleEnrollTOTP)
+			r.Post("/mfa/totp/confirm", apiCfg.handleConfirmTOTP)
+			r.Delete("/mfa/totp", apiCfg.handleDisableTOTP)
+			r.Post("/oauth/clients", apiCfg.handleCreateOAuthClient)
+			r.Get("/oauth/clients", apiCfg.handleListOAuthClients)
+			r.Delete("/oauth/clients/{clientID}", apiCfg.handleDeleteOAuthClient)
+			r.Get("/identities", apiCfg.handleListIdentities)
+			r.Delete("/identities", apiCfg.handleUnlinkIdentity)
+			r.Post("/keys", apiCfg.handleCreateAPIKey)
+			r.Get("/keys", apiCfg.handleListAPIKeys)
+			r.Delete("/keys/{keyID}", apiCfg.handleDeleteAPIKey)
+		})
+	})
 
+	oauthRouter := chi.NewRouter()
+	oauthRouter.Get("/authorize", apiCfg.handleAuthorize)
+	oauthRouter.Post("/authorize", apiCfg.handleAuthorizeDecision)
+	oauthRouter.Post("/token", apiCfg.handleToken)
+	oauthRouter.Post("/introspect", apiCfg.handleIntrospect)
+	oauthRouter.Post("/revoke", apiCfg.handleRevokeOAuthToken)
+
+	r.Get("/.well-known/jwks.json", apiCfg.handleJWKS)
 	r.Handle("/app/*", fsHandler)
 	r.Handle("/app", fsHandler)
 	r.Mount("/api", apiRouter)
 	r.Mount("/admin", adminRouter)
+	r.Mount("/oauth", oauthRouter)
 
 	http.ListenAndServe(":8080", corsMux)
 }
+
+func openDB(engine string, path string, opts ...database.Option) (*database.DB, error) {
+	switch engine {
+	case "wal":
+		return database.NewWALDB(path, opts...)
+	case "memory":
+		return database.NewMemoryDB(), nil
+	default:
+		return database.NewDB(path, opts...)
+	}
+}
+
+// openReadOnlyDB reads the database without locking it, for commands that
+// only read and may run next to the server.
+func openReadOnlyDB(engine string, path string) (*database.DB, error) {
+	switch engine {
+	case "wal":
+		return database.NewReadOnlyWALDB(path)
+	case "memory":
+		return database.NewMemoryDB(), nil
+	default:
+		return database.NewReadOnlyDB(path)
+	}
+}
+
+func keysDir() string {
+	if dir := os.Getenv("JWT_KEYS_DIR"); dir != "" {
+		return dir
+	}
+	return "keys"
+}
+
+// loadKeys opens the signing key directory.
+func loadKeys() (*auth.KeyManager, error) {
+	return auth.LoadKeyDir(keysDir())
+}
+
+// newMailer picks how emails go out from MAILER: "smtp" relays through
+// SMTP_ADDR, "file" appends to MAIL_FILE and "log" logs them. Emails carry
+// reset and verification links, so logging them is only the default while
+// the app runs on this machine.
+func newMailer(appURL string) (mailer.Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "chirpy@localhost"
+	}
+	switch os.Getenv("MAILER") {
+	case "smtp":
+		return mailer.NewSMTPMailer(os.Getenv("SMTP_ADDR"), os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), from)
+	case "file":
+		path := os.Getenv("MAIL_FILE")
+		if path == "" {
+			path = "mail.log"
+		}
+		return mailer.NewFileMailer(path, from), nil
+	case "log":
+		return mailer.LogMailer{}, nil
+	case "":
+		if !localURL(appURL) {
+			return nil, fmt.Errorf("MAILER must be set to smtp, file or log when APP_URL is %s", appURL)
+		}
+		return mailer.LogMailer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown MAILER %q", os.Getenv("MAILER"))
+	}
+}
+
+func localURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(u.Hostname())
+	return u.Hostname() == "localhost" || ip != nil && ip.IsLoopback()
+}
+
+// loadHashParams reads how new password hashes are made from PASSWORD_HASH
+// (bcrypt or argon2id), BCRYPT_COST, ARGON2_TIME, ARGON2_MEMORY in KiB and
+// ARGON2_THREADS.
+func loadHashParams() (auth.HashParams, error) {
+	params := auth.DefaultHashParams()
+	if algorithm := os.Getenv("PASSWORD_HASH"); algorithm != "" {
+		params.Algorithm = algorithm
+	}
+	cost, err := envInt("BCRYPT_COST", params.BcryptCost)
+	if err != nil {
+		return auth.HashParams{}, err
+	}
+	iterations, err := envInt("ARGON2_TIME", int(params.Argon2Time))
+	if err != nil {
+		return auth.HashParams{}, err
+	}
+	memory, err := envInt("ARGON2_MEMORY", int(params.Argon2Memory))
+	if err != nil {
+		return auth.HashParams{}, err
+	}
+	threads, err := envInt("ARGON2_THREADS", int(params.Argon2Threads))
+	if err != nil {
+		return auth.HashParams{}, err
+	}
+	if iterations < 0 || memory < 0 || threads < 0 || threads > 255 {
+		return auth.HashParams{}, fmt.Errorf("argon2 parameters out of range")
+	}
+	params.BcryptCost = cost
+	params.Argon2Time = uint32(iterations)
+	params.Argon2Memory = uint32(memory)
+	params.Argon2Threads = uint8(threads)
+	return params, params.Validate()
+}
+
+// loadPasswordPolicy builds the password policy from PASSWORD_MIN_LENGTH,
+// PASSWORD_MAX_BYTES, a PASSWORD_BANNED_FILE with one password per line and
+// a PASSWORD_BREACHED_DIR of breached password range files. The maximum is
+// capped at what the hash algorithm can use.
+func loadPasswordPolicy(hashParams auth.HashParams) (*auth.PasswordPolicy, error) {
+	limit := hashParams.MaxPasswordBytes()
+	if limit == 0 {
+		limit = 1024
+	}
+	minLength, err := envInt("PASSWORD_MIN_LENGTH", 8)
+	if err != nil {
+		return nil, err
+	}
+	maxBytes, err := envInt("PASSWORD_MAX_BYTES", limit)
+	if err != nil {
+		return nil, err
+	}
+	if limit := hashParams.MaxPasswordBytes(); limit > 0 {
+		maxBytes = min(maxBytes, limit)
+	}
+	policy := auth.NewPasswordPolicy(minLength, maxBytes)
+	if path := os.Getenv("PASSWORD_BANNED_FILE"); path != "" {
+		err := policy.LoadBannedFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if dir := os.Getenv("PASSWORD_BREACHED_DIR"); dir != "" {
+		list, err := auth.NewBreachedList(dir)
+		if err != nil {
+			return nil, err
+		}
+		policy.CheckBreached(list)
+	}
+	return policy, nil
+}
+
+// loadOIDCProvider sets up login with the OpenID Connect provider at
+// OIDC_ISSUER, registered with OIDC_CLIENT_ID and OIDC_CLIENT_SECRET, which
+// sends users back to OIDC_REDIRECT_URL.
+func loadOIDCProvider() (*auth.OIDCProvider, error) {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil, nil
+	}
+	clientID := os.Getenv("OIDC_CLIENT_ID")
+	if clientID == "" {
+		return nil, fmt.Errorf("OIDC_ISSUER is set without OIDC_CLIENT_ID")
+	}
+	redirectURL := os.Getenv("OIDC_REDIRECT_URL")
+	if redirectURL == "" {
+		redirectURL = "http://localhost:8080/api/oidc/callback"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	return auth.DiscoverOIDCProvider(ctx, issuer, clientID, os.Getenv("OIDC_CLIENT_SECRET"), redirectURL)
+}
+
+func envInt(name string, fallback int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return n, nil
+}
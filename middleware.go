@@ -1,11 +1,18 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"errors"
+	"github/ntvviktor/GoServer/internal/auth"
+	"net/http"
+	"strings"
+	"time"
+)
 
 func MiddlewareCors(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, PATCH, DELETE")
 		w.Header().Set("Access-Control-Allow-Headers", "*")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -14,3 +21,95 @@ func MiddlewareCors(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+type contextKey int
+
+const identityKey contextKey = iota
+
+// identity is the authenticated caller of a request. SessionID is zero for
+// a personal API key.
+type identity struct {
+	UserID    int
+	SessionID int
+	Role      string
+	Scopes    []string
+}
+
+// middlewareAuth lets a request through only with a valid access token
+// whose session has not been revoked, or a valid personal API key, and
+// stores the caller's identity in the request context for the handler.
+func (apiConfig *apiConfig) middlewareAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if apiKey, isKey := getAPIKeyFromHeader(req); isKey {
+			caller, err := apiConfig.apiKeyIdentity(apiKey)
+			if err != nil {
+				respondWithError(w, http.StatusUnauthorized, "Invalid API key")
+				return
+			}
+			ctx := context.WithValue(req.Context(), identityKey, caller)
+			next.ServeHTTP(w, req.WithContext(ctx))
+			return
+		}
+
+		tokenString, canCut := getTokenFromHeader(req)
+		if !canCut {
+			respondWithError(w, http.StatusUnauthorized, "Malformed request token string")
+			return
+		}
+		userID, claims, err := auth.ValidateJWT(tokenString, apiConfig.keys, auth.AccessToken)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Invalid token")
+			return
+		}
+		session, err := apiConfig.DB.GetSession(claims.SessionID)
+		if err != nil || session.UserID != userID || session.RevokedAt != nil {
+			respondWithError(w, http.StatusUnauthorized, "Session revoked")
+			return
+		}
+		// A token minted before a role change must be refreshed, so a
+		// demotion takes effect at once.
+		user, err := apiConfig.DB.GetUser(userID)
+		if err != nil || user.Role != claims.Role {
+			respondWithError(w, http.StatusUnauthorized, "Token outdated")
+			return
+		}
+
+		apiConfig.activity.seenSession(session.ID, clientIP(req))
+
+		ctx := context.WithValue(req.Context(), identityKey, identity{
+			UserID:    userID,
+			SessionID: session.ID,
+			Role:      claims.Role,
+			Scopes:    strings.Fields(claims.Scope),
+		})
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+var errInvalidAPIKey = errors.New("invalid API key")
+
+// apiKeyIdentity returns who a personal API key acts for. The role is the
+// user's current one, so a demotion also takes effect at once.
+func (apiConfig *apiConfig) apiKeyIdentity(apiKey string) (identity, error) {
+	key, err := apiConfig.DB.GetAPIKeyByHash(auth.HashToken(apiKey))
+	if err != nil || time.Now().After(key.ExpiresAt) {
+		return identity{}, errInvalidAPIKey
+	}
+	user, err := apiConfig.DB.GetUser(key.UserID)
+	if err != nil {
+		return identity{}, errInvalidAPIKey
+	}
+	apiConfig.activity.seenAPIKey(key.Hash)
+	return identity{
+		UserID: user.ID,
+		Role:   user.Role,
+		Scopes: key.Scopes,
+	}, nil
+}
+
+// requestIdentity returns the identity middlewareAuth stored. Handlers behind
+// the middleware can rely on it being there.
+func requestIdentity(req *http.Request) identity {
+	id, _ := req.Context().Value(identityKey).(identity)
+	return id
+}
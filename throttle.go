@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// accountFreeAttempts and ipFreeAttempts are how many failed logins an
+	// account or a client address gets before each further failure doubles
+	// the wait, up to maxLockout.
+	accountFreeAttempts = 5
+	ipFreeAttempts      = 20
+	maxLockout          = time.Hour
+	// forgetFailuresAfter is how long failures are remembered after the last
+	// one.
+	forgetFailuresAfter = 24 * time.Hour
+)
+
+// loginThrottle counts failed logins per account and per client address. It
+// lives in memory: losing it on restart only hands out a few extra attempts.
+// Accounts are keyed by email rather than user ID so unknown emails are
+// throttled exactly like real ones.
+type loginThrottle struct {
+	mux      sync.Mutex
+	failures map[string]failedLogins
+}
+
+type failedLogins struct {
+	count int
+	last  time.Time
+}
+
+func newLoginThrottle() *loginThrottle {
+	return &loginThrottle{
+		failures: map[string]failedLogins{},
+	}
+}
+
+// accountKey normalizes email the way the user index does, so every
+// spelling that logs in to one account shares its lockout.
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// reserve is how long a login for email from ip has to wait, zero if it may
+// go ahead. An attempt that may go ahead is counted as failed right away, so
+// concurrent guesses cannot all get in before the first of them fails;
+// release takes the attempt back once it succeeded.
+func (t *loginThrottle) reserve(email string, ip string) time.Duration {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	now := time.Now()
+	wait := max(t.wait(accountKey(email), accountFreeAttempts, now), t.wait(ipKey(ip), ipFreeAttempts, now))
+	if wait > 0 {
+		return wait
+	}
+	for _, key := range []string{accountKey(email), ipKey(ip)} {
+		v := t.failures[key]
+		v.count++
+		v.last = now
+		t.failures[key] = v
+	}
+	return 0
+}
+
+func (t *loginThrottle) wait(key string, free int, now time.Time) time.Duration {
+	v, ok := t.failures[key]
+	if !ok {
+		return 0
+	}
+	return max(v.last.Add(backoff(v.count, free)).Sub(now), 0)
+}
+
+// backoff is the wait after count failures: nothing for the first free ones,
+// then one second, doubling with every further failure.
+func backoff(count int, free int) time.Duration {
+	if count <= free {
+		return 0
+	}
+	exp := min(count-free-1, 30)
+	return min(time.Second<<exp, maxLockout)
+}
+
+// release takes back the attempt reserve counted for a login step that
+// succeeded.
+func (t *loginThrottle) release(email string, ip string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	for _, key := range []string{accountKey(email), ipKey(ip)} {
+		v, ok := t.failures[key]
+		if !ok {
+			continue
+		}
+		v.count--
+		if v.count <= 0 {
+			delete(t.failures, key)
+			continue
+		}
+		t.failures[key] = v
+	}
+}
+
+// unlock forgets the failed logins of an account. Client addresses are left
+// alone; they only decay.
+func (t *loginThrottle) unlock(email string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	delete(t.failures, accountKey(email))
+}
+
+func (t *loginThrottle) prune() {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	for key, v := range t.failures {
+		if time.Since(v.last) > forgetFailuresAfter {
+			delete(t.failures, key)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// Concurrent guesses must not all get in before the first of them fails.
+func TestLoginThrottleConcurrentGuesses(t *testing.T) {
+	throttle := newLoginThrottle()
+	allowed := 0
+	mux := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if throttle.reserve("alice@example.com", "192.0.2.1") == 0 {
+				mux.Lock()
+				allowed++
+				mux.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != accountFreeAttempts+1 {
+		t.Errorf("%d of 50 concurrent guesses went ahead, want %d", allowed, accountFreeAttempts+1)
+	}
+}
+
+func TestLoginThrottleRelease(t *testing.T) {
+	throttle := newLoginThrottle()
+	for i := 0; i < accountFreeAttempts*3; i++ {
+		if wait := throttle.reserve("alice@example.com", "192.0.2.1"); wait > 0 {
+			t.Fatalf("successful login %d had to wait %v", i+1, wait)
+		}
+		throttle.release("alice@example.com", "192.0.2.1")
+	}
+	if len(throttle.failures) != 0 {
+		t.Errorf("successful logins left failures behind: %v", throttle.failures)
+	}
+}
+
+// Spellings of an email that reach the same account share its lockout.
+func TestLoginThrottleEmailVariants(t *testing.T) {
+	throttle := newLoginThrottle()
+	variants := []string{"alice@example.com", " alice@example.com", "ALICE@example.com ", "\talice@Example.com\n"}
+	for i := 0; i <= accountFreeAttempts; i++ {
+		email := variants[i%len(variants)]
+		if wait := throttle.reserve(email, fmt.Sprintf("192.0.2.%d", i)); wait > 0 {
+			t.Fatalf("guess %d (%q) had to wait %v", i+1, email, wait)
+		}
+	}
+	for i, email := range variants {
+		if throttle.reserve(email, fmt.Sprintf("198.51.100.%d", i)) == 0 {
+			t.Errorf("%q went ahead after the account was locked", email)
+		}
+	}
+}
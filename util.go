@@ -4,9 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func (apiConfig *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
@@ -74,3 +76,22 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 
 	w.Write(dat)
 }
+
+// runEvery calls task once per interval for as long as the server runs.
+func runEvery(interval time.Duration, task func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		task()
+	}
+}
+
+// clientIP is the address the request came from. Forwarding headers are
+// ignored because nothing guarantees a trusted proxy set them.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}